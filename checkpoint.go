@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+const checkpointVersion = 2
+
+// The progress of a run, saved in the checkpoint directory together with the collected paths and the state of each
+// filesystem after the last completed pass
+type checkpointMeta struct {
+	Version int
+	// the arguments that determine the collected files and their state, which must be equal when resuming
+	Roots  []string
+	Hash   string
+	Lowmem bool
+
+	Filesystems []checkpointFilesystem
+	Subvolumes  []checkpointSubvolume
+	// the last pass that is completed by all filesystems, 0 if only the files are collected
+	Pass int
+	// the filesystem that is being processed in the next pass, the filesystems before it completed that pass already
+	Filesystem int
+	// the number of partitions of the filesystem that are processed in pass 3 or 4. The groups that are found in pass 3
+	// so far are stored in the group file, of which the first GroupsLength bytes are valid.
+	Partitions   int
+	GroupsLength int64
+}
+
+type checkpointFilesystem struct {
+	ID         [16]byte
+	SectorSize int64
+}
+
+type checkpointSubvolume struct {
+	Path       string
+	Generation uint64
+}
+
+// Saves the progress of the run, so it can be resumed when it is interrupted. All methods can be called on a nil
+// checkpoint, in which case they do nothing.
+type checkpoint struct {
+	dir      string
+	interval time.Duration
+	meta     checkpointMeta
+	lastSave time.Time
+	// the groups that are found in pass 3 for the filesystem that is being processed
+	groups *storage.GroupWriter
+	// true if the run is resumed from the checkpoint, the files are checked for changes before they are processed
+	resumed bool
+}
+
+func newCheckpoint(dir string, interval time.Duration, roots []string, hashName string, lowmem bool) (*checkpoint, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating checkpoint directory failed")
+	}
+	meta := checkpointMeta{Version: checkpointVersion, Roots: roots, Hash: hashName, Lowmem: lowmem}
+	return &checkpoint{dir: dir, interval: interval, meta: meta, lastSave: time.Now()}, nil
+}
+
+// Loads the checkpoint from the directory, returns an error if it is not created by a run with the same arguments
+func loadCheckpoint(dir string, interval time.Duration, roots []string, hashName string, lowmem bool) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint failed")
+	}
+	c := &checkpoint{dir: dir, interval: interval, lastSave: time.Now(), resumed: true}
+	if err := json.Unmarshal(data, &c.meta); err != nil {
+		return nil, errors.Wrap(err, "parsing checkpoint failed")
+	}
+	switch {
+	case c.meta.Version != checkpointVersion:
+		return nil, errors.Errorf("unsupported checkpoint version %d", c.meta.Version)
+	case !reflect.DeepEqual(c.meta.Roots, roots):
+		return nil, errors.Errorf("the checkpoint is created for %v", c.meta.Roots)
+	case c.meta.Hash != hashName:
+		return nil, errors.Errorf("the checkpoint is created with hash algorithm %s", c.meta.Hash)
+	case c.meta.Lowmem != lowmem:
+		return nil, errors.Errorf("the checkpoint is created with lowmem=%v", c.meta.Lowmem)
+	}
+	return c, nil
+}
+
+func (c *checkpoint) file(format string, args ...interface{}) string {
+	return filepath.Join(c.dir, fmt.Sprintf(format, args...))
+}
+
+func (c *checkpoint) stateFile(fs *filesystem, pass int) string {
+	return c.file("state-%d-%d", fs.index, pass)
+}
+
+func (c *checkpoint) save() {
+	data, err := json.Marshal(c.meta)
+	if err == nil {
+		err = storage.WriteAtomically(c.file("meta.json"), data, 0600)
+	}
+	if err != nil {
+		log.Fatalf("Unable to save checkpoint: %v", err)
+	}
+	c.lastSave = time.Now()
+}
+
+// Saves the collected files
+func (c *checkpoint) filesCollected(ctx context, subvolumes []scannedSubvolume) {
+	if c == nil {
+		return
+	}
+	for _, fs := range ctx.fs.list {
+		c.meta.Filesystems = append(c.meta.Filesystems, checkpointFilesystem{fs.id, fs.sectorSize})
+	}
+	for _, subvolume := range subvolumes {
+		c.meta.Subvolumes = append(c.meta.Subvolumes, checkpointSubvolume{subvolume.path, subvolume.generation})
+	}
+	files := make([]byte, 2*len(ctx.fs.files))
+	for i, index := range ctx.fs.files {
+		binary.LittleEndian.PutUint16(files[2*i:], index)
+	}
+	err := ctx.pathstore.Save(c.file("paths"))
+	if err == nil {
+		err = storage.WriteAtomically(c.file("filesystems"), files, 0600)
+	}
+	if err == nil {
+		err = c.saveLinks(ctx.links)
+	}
+	if err != nil {
+		log.Fatalf("Unable to save checkpoint: %v", err)
+	}
+	c.save()
+}
+
+// Restores the collected files and the state of each filesystem, returns the subvolumes that are scanned incrementally
+func (c *checkpoint) restore(ctx *context) ([]scannedSubvolume, error) {
+	pathstore, err := storage.LoadPathStorage(c.file("paths"))
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadFile(c.file("filesystems"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint failed")
+	}
+	if len(files) != 2*pathstore.FileCount() {
+		return nil, errors.New("the filesystems in the checkpoint do not match the files")
+	}
+	ctx.pathstore = pathstore
+	for _, saved := range c.meta.Filesystems {
+		ctx.fs.add(saved.ID, saved.SectorSize)
+	}
+	ctx.fs.files = make([]uint16, len(files)/2)
+	for i := range ctx.fs.files {
+		ctx.fs.files[i] = binary.LittleEndian.Uint16(files[2*i:])
+		if int(ctx.fs.files[i]) >= len(ctx.fs.list) {
+			return nil, errors.New("the filesystems in the checkpoint do not match the files")
+		}
+	}
+	for _, fs := range ctx.fs.list {
+		pass := c.meta.Pass
+		if int(fs.index) < c.meta.Filesystem {
+			pass++
+		}
+		if pass > 0 && pass < 4 {
+			if err := fs.state.Restore(c.stateFile(fs, pass), pass); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := c.restoreLinks(ctx); err != nil {
+		return nil, err
+	}
+	var subvolumes []scannedSubvolume
+	for _, subvolume := range c.meta.Subvolumes {
+		subvolumes = append(subvolumes, scannedSubvolume{subvolume.Path, subvolume.Generation})
+	}
+	log.Printf("Resuming after pass %d with %d files", c.meta.Pass, pathstore.FileCount())
+	return subvolumes, nil
+}
+
+// Saves the other names of the files with hard links, the inodes are not needed anymore once the files are collected
+func (c *checkpoint) saveLinks(links *hardlinks) error {
+	data, err := json.Marshal(links.aliases)
+	if err != nil {
+		return errors.Wrap(err, "encoding hard links failed")
+	}
+	return storage.WriteAtomically(c.file("links"), data, 0600)
+}
+
+// Restores the other names of the files with hard links and counts them as skipped again
+func (c *checkpoint) restoreLinks(ctx *context) error {
+	data, err := ioutil.ReadFile(c.file("links"))
+	if err != nil {
+		return errors.Wrap(err, "reading checkpoint failed")
+	}
+	aliases := make(map[int32][]string)
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return errors.Wrap(err, "parsing hard links failed")
+	}
+	ctx.links.aliases = aliases
+	for _, names := range aliases {
+		ctx.links.count += len(names)
+		for range names {
+			ctx.stats.FileSkipped(storage.SkippedHardLink)
+		}
+	}
+	return nil
+}
+
+// Returns true if the pass is completed before the run was resumed
+func (c *checkpoint) completed(pass int) bool {
+	return c != nil && pass <= c.meta.Pass
+}
+
+// Returns true if the filesystem completed the pass before the run was resumed
+func (c *checkpoint) skip(fs *filesystem, pass int) bool {
+	return c.completed(pass) || c != nil && pass == c.meta.Pass+1 && int(fs.index) < c.meta.Filesystem
+}
+
+// Saves the state of the filesystem after the pass
+func (c *checkpoint) filesystemCompleted(fs *filesystem, pass int) {
+	if c == nil {
+		return
+	}
+	if pass < 4 {
+		if err := fs.state.Save(c.stateFile(fs, pass), pass); err != nil {
+			log.Fatalf("Unable to save checkpoint: %v", err)
+		}
+	}
+	c.meta.Filesystem = int(fs.index) + 1
+	c.meta.Partitions, c.meta.GroupsLength = 0, 0
+	c.save()
+	if c.groups != nil {
+		c.groups.Close()
+		c.groups = nil
+		os.Remove(c.file("groups-%d", fs.index))
+	}
+}
+
+// Saves the state of all filesystems after the pass, or removes the checkpoint after the last pass
+func (c *checkpoint) passCompleted(ctx context, pass int) {
+	if c == nil {
+		return
+	}
+	if pass == 4 {
+		if err := os.RemoveAll(c.dir); err != nil {
+			log.Printf("Unable to remove checkpoint: %v", err)
+		}
+		return
+	}
+	if pass == 1 {
+		for _, fs := range ctx.fs.list {
+			if err := fs.state.Save(c.stateFile(fs, pass), pass); err != nil {
+				log.Fatalf("Unable to save checkpoint: %v", err)
+			}
+		}
+	}
+	c.meta.Pass = pass
+	c.meta.Filesystem, c.meta.Partitions, c.meta.GroupsLength = 0, 0, 0
+	c.save()
+	for _, fs := range ctx.fs.list {
+		os.Remove(c.stateFile(fs, pass-1))
+	}
+}
+
+// Returns the position of the filesystem in a pass that has been interrupted, 0 if the pass is not started yet
+func (c *checkpoint) startFilesystem(fs *filesystem) (partitions int, groupsLength int64) {
+	if c.meta.Filesystem != int(fs.index) {
+		c.meta.Filesystem, c.meta.Partitions, c.meta.GroupsLength = int(fs.index), 0, 0
+	}
+	return c.meta.Partitions, c.meta.GroupsLength
+}
+
+// Wraps the receiver of pass 3, such that the partitions that were processed before the interruption are skipped and
+// the groups that are found are saved periodically
+func (c *checkpoint) verifyReceiver(ctx context, fs *filesystem, receiver func(files []*storage.FileInformation) [][]*storage.FileInformation) func(files []*storage.FileInformation) [][]*storage.FileInformation {
+	if c == nil {
+		return receiver
+	}
+	skip, length := c.startFilesystem(fs)
+	groups, restored, err := storage.OpenGroupWriter(c.file("groups-%d", fs.index), length)
+	if err != nil {
+		log.Fatalf("Unable to restore checkpoint: %v", err)
+	}
+	c.groups = groups
+	partition := 0
+	return func(files []*storage.FileInformation) [][]*storage.FileInformation {
+		if ctx.interrupt.interrupted() {
+			return nil
+		}
+		partition++
+		if partition <= skip {
+			// the groups found in the skipped partitions are passed on at once
+			if partition == 1 {
+				return restored
+			}
+			return nil
+		}
+		result := receiver(c.unchanged(ctx, files))
+		if ctx.interrupt.interrupted() {
+			// the partition may not be processed completely
+			return nil
+		}
+		for _, group := range result {
+			if err := c.groups.Add(group); err != nil {
+				log.Fatalf("Unable to save checkpoint: %v", err)
+			}
+		}
+		c.meta.Partitions = partition
+		if time.Since(c.lastSave) >= c.interval {
+			c.saveProgress()
+		}
+		return result
+	}
+}
+
+// Wraps the receiver of pass 4, such that the groups that were processed before the interruption are skipped and the
+// progress is saved periodically
+func (c *checkpoint) dedupReceiver(ctx context, fs *filesystem, receiver func(files []*storage.FileInformation)) func(files []*storage.FileInformation) {
+	if c == nil {
+		return receiver
+	}
+	skip, _ := c.startFilesystem(fs)
+	partition := 0
+	return func(files []*storage.FileInformation) {
+		if ctx.interrupt.interrupted() {
+			return
+		}
+		partition++
+		if partition <= skip {
+			return
+		}
+		receiver(c.unchanged(ctx, files))
+		if ctx.interrupt.interrupted() {
+			// the group may not be deduplicated completely
+			return
+		}
+		c.meta.Partitions = partition
+		if time.Since(c.lastSave) >= c.interval {
+			c.saveProgress()
+		}
+	}
+}
+
+// Saves the position in the pass that is in progress, with the groups that are found so far in pass 3
+func (c *checkpoint) saveProgress() {
+	if c == nil {
+		return
+	}
+	if c.groups != nil {
+		length, err := c.groups.Sync()
+		if err != nil {
+			log.Fatalf("Unable to save checkpoint: %v", err)
+		}
+		c.meta.GroupsLength = length
+	}
+	c.save()
+}
+
+// Returns the files that did not change since they were scanned, if the run is resumed
+func (c *checkpoint) unchanged(ctx context, files []*storage.FileInformation) []*storage.FileInformation {
+	if !c.resumed {
+		return files
+	}
+	result := make([]*storage.FileInformation, 0, len(files))
+	for _, file := range files {
+		path := ctx.pathstore.FilePath(file.Path)
+		current, err := readFileMeta(file.Path, path)
+		if err != nil || current == nil || current.Size != file.Size || !sameFragments(current.Fragments, file.Fragments) {
+			log.Printf("Skipping %s, it has changed since the checkpoint", path)
+			continue
+		}
+		result = append(result, file)
+	}
+	return result
+}
+
+func sameFragments(a, b []sys.Fragment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
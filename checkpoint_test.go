@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/storage"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResumeVerificationAfterInterruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	roots := []string{"/mnt"}
+	fs := &filesystem{sectorSize: 4096, state: storage.NewMemoryBased()}
+	partitions := [][]*storage.FileInformation{
+		{{Path: 0, Size: 10}, {Path: 1, Size: 10}},
+		{{Path: 2, Size: 20}, {Path: 3, Size: 20}},
+	}
+	verified := 0
+	verify := func(files []*storage.FileInformation) [][]*storage.FileInformation {
+		verified++
+		return [][]*storage.FileInformation{files}
+	}
+
+	c, err := newCheckpoint(dir, 0, roots, "xxh3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.meta.Pass = 2
+	receiver := c.verifyReceiver(context{}, fs, verify)
+	receiver(partitions[0])
+	// the run is interrupted before the second partition is processed
+	c.groups.Close()
+
+	c, err = loadCheckpoint(dir, 0, roots, "xxh3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.resumed = false
+	receiver = c.verifyReceiver(context{}, fs, verify)
+	groups := receiver(partitions[0])
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][1].Path != 1 {
+		t.Errorf("Expected the group of the first partition to be restored, but was %v", groups)
+	}
+	groups = receiver(partitions[1])
+	if len(groups) != 1 || groups[0][0].Path != 2 {
+		t.Errorf("Expected the second partition to be verified, but was %v", groups)
+	}
+	if verified != 2 {
+		t.Errorf("Expected the first partition to be verified only once, but was verified %d times", verified)
+	}
+
+	if _, err := loadCheckpoint(dir, 0, []string{"/other"}, "xxh3", false); err == nil {
+		t.Errorf("Expected a checkpoint for other paths to be refused")
+	}
+}
+
+func TestHardLinksRestored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := newCheckpoint(dir, 0, []string{"/mnt"}, "xxh3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := newHardlinks()
+	links.aliases[3] = []string{"/mnt/a", "/mnt/b"}
+	links.count = 2
+	if err := c.saveLinks(links); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := storage.NewProgressLogStats()
+	stats.Start()
+	defer stats.Stop()
+	ctx := context{stats: stats, links: newHardlinks()}
+	if err := c.restoreLinks(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	if aliases := ctx.links.aliasesOf(3); len(aliases) != 2 || aliases[1] != "/mnt/b" || ctx.links.count != 2 {
+		t.Errorf("Expected the aliases to be restored, but was %v", aliases)
+	}
+	if skipped := stats.Report().Skipped[storage.SkippedHardLink]; skipped != 2 {
+		t.Errorf("Expected the hard links to be reported as skipped, but was %d", skipped)
+	}
+}
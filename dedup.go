@@ -4,57 +4,130 @@ import (
 	"github.com/bertbaron/btrdedup/sys"
 	"log"
 	"os"
+	"sort"
 )
 
 const (
 	maxSize uint64 = 64 * 1024 * 1024
 )
 
+// A range of bytes at the same logical offset in each of the files
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// Results of deduplication requests
+type dedupResult struct {
+	// bytes deduplicated according to the kernel, summed over the destinations
+	bytesDeduped uint64
+	// number of destinations for which the kernel reported that the data differs
+	dataDiffers int
+	// number of requests or destinations that failed
+	errors int
+}
+
+func (r *dedupResult) add(other dedupResult) {
+	r.bytesDeduped += other.bytesDeduped
+	r.dataDiffers += other.dataDiffers
+	r.errors += other.errors
+}
+
 // returns true if deduplication was successfull, false otherwise
-func dedup(filenames []string, offset, length uint64) bool {
+func dedup(filenames []string, offset, length uint64) (bool, dedupResult) {
+	var total dedupResult
 	same := make([]sys.BtrfsSameExtendInfo, 0)
 	for _, filename := range filenames {
 		if file, err := os.OpenFile(filename, os.O_RDONLY, 0); err != nil {
 			log.Printf("Skipping %s, error while opening: %v", filename, err)
 		} else {
 			defer file.Close()
-			same = append(same, sys.BtrfsSameExtendInfo{file, offset})
+			same = append(same, sys.BtrfsSameExtendInfo{File: file, LogicalOffset: offset})
 		}
 	}
 	if len(same) < 2 {
-		return false
+		return false, total
 	}
 
 	result, err := sys.BtrfsExtendSame(same, length)
 	if err != nil {
 		log.Printf("Error while deduplicating %s and %d other files: %v", filenames[0], len(filenames)-1, err)
-		return false
+		total.errors++
+		return false, total
 	}
 	var bytesDeduped uint64 = 0
 	dataDiffers := false
 	for _, r := range result {
 		dataDiffers = dataDiffers || r.DataDiffers
+		if r.DataDiffers {
+			total.dataDiffers++
+		}
+		if r.Error != nil {
+			total.errors++
+		}
+		total.bytesDeduped += r.BytesDeduped
 		if r.BytesDeduped > bytesDeduped {
 			bytesDeduped = r.BytesDeduped
 		}
 	}
 	log.Printf("Result for length %d: same=%v, deduped=%d\n", length, !dataDiffers, bytesDeduped)
-	return !dataDiffers 
+	return !dataDiffers, total
 }
 
-// Returns true if deduplication was successfull
-func Dedup(filenames []string, offset, length uint64) {
+// Returns the length of the parts in which a range of the given number of files is deduplicated, a multiple of the
+// block size of at most maxSize for all files together. Large groups are deduplicated one block at a time, so the
+// requests always make progress.
+func chunkSize(files int, blockSize uint64) uint64 {
+	max := maxSize / uint64(files)
+	max -= max % blockSize
+	if max < blockSize {
+		return blockSize
+	}
+	return max
+}
+
+// Deduplicates the range until the data is different or the run is interrupted. Requests are split in parts that are a
+// multiple of the block size.
+func Dedup(filenames []string, offset, length, blockSize uint64, interrupt *interruption) dedupResult {
+	var total dedupResult
 	size := offset + length
 
-	max := maxSize / uint64(len(filenames))
+	max := chunkSize(len(filenames), blockSize)
 	same := true
 	// continue until the data is different
-	for same && offset < size {
+	for same && offset < size && !interrupt.interrupted() {
 		len := size - offset
 		if len > max {
-			len = max &^ 0x0FFF // multiple of 4k
+			len = max
 		}
-		same = same && dedup(filenames, offset, len)
+		var result dedupResult
+		same, result = dedup(filenames, offset, len)
+		total.add(result)
 		offset = offset + len
 	}
+	return total
+}
+
+// Deduplicates the given ranges of each of the destination files towards the source file. Destinations that need the
+// same range to be deduplicated are offered to the kernel together.
+func DedupRanges(source string, dests []string, ranges [][]byteRange, blockSize uint64, interrupt *interruption) dedupResult {
+	filesByRange := make(map[byteRange][]string)
+	var keys []byteRange
+	for i, dest := range dests {
+		for _, r := range ranges[i] {
+			if _, ok := filesByRange[r]; !ok {
+				keys = append(keys, r)
+				filesByRange[r] = []string{source}
+			}
+			filesByRange[r] = append(filesByRange[r], dest)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].offset < keys[j].offset || keys[i].offset == keys[j].offset && keys[i].length < keys[j].length
+	})
+	var total dedupResult
+	for _, r := range keys {
+		total.add(Dedup(filesByRange[r], uint64(r.offset), uint64(r.length), blockSize, interrupt))
+	}
+	return total
 }
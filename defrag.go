@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"log"
+	"sort"
+)
+
+// In the defrag mode all fragmented files are defragmented, not only the ones with duplicates. A defragmented file no
+// longer shares its extents, so its copies, like reflinked copies and files in snapshots, are found by the physical
+// ranges they share with it, wherever they are on the filesystem. After the defragmentation the copies are deduplicated
+// towards the defragmented file again. A file is only defragmented if all its copies can be relinked, otherwise the
+// defragmentation would unshare their data.
+
+// A range on disk referenced by a file
+type physicalRange struct {
+	start, length uint64
+	path          int32
+}
+
+// Returns true if the fragment has a location on disk that can be shared. The location of compressed data is the start
+// of the compressed extent, so it is only shared by references to the same extent.
+func hasLocation(frag sys.Fragment) bool {
+	return frag.Flags&(sys.FIEMAP_EXTENT_UNKNOWN|sys.FIEMAP_EXTENT_DELALLOC|sys.FIEMAP_EXTENT_DATA_INLINE) == 0
+}
+
+// Returns the physical ranges of the file, up to its size
+func physicalRanges(file *storage.FileInformation) []physicalRange {
+	return physicalRangesWhere(file, hasLocation)
+}
+
+// Returns the physical ranges of the fragments of the file that match the predicate, up to its size
+func physicalRangesWhere(file *storage.FileInformation, predicate func(frag sys.Fragment) bool) []physicalRange {
+	var ranges []physicalRange
+	for _, frag := range file.Fragments {
+		if !predicate(frag) || int64(frag.Logical) >= file.Size {
+			continue
+		}
+		length := frag.Length
+		if end := uint64(file.Size); frag.Logical+length > end {
+			length = end - frag.Logical
+		}
+		ranges = append(ranges, physicalRange{frag.Start, length, file.Path})
+	}
+	return ranges
+}
+
+// Index of physical ranges to find the ranges that overlap with a given range
+type physicalIndex struct {
+	ranges    []physicalRange
+	maxLength uint64
+}
+
+func (x *physicalIndex) add(ranges ...physicalRange) {
+	for _, r := range ranges {
+		x.ranges = append(x.ranges, r)
+		if r.length > x.maxLength {
+			x.maxLength = r.length
+		}
+	}
+}
+
+// Must be called after adding the ranges and before looking them up
+func (x *physicalIndex) sort() {
+	sort.Slice(x.ranges, func(i, j int) bool { return x.ranges[i].start < x.ranges[j].start })
+}
+
+// Calls the receiver for each range in the index that overlaps with r, with the number of overlapping bytes
+func (x *physicalIndex) overlapping(r physicalRange, receiver func(other physicalRange, overlap uint64)) {
+	// no range starting before r.start-maxLength can reach r
+	from := uint64(0)
+	if r.start > x.maxLength {
+		from = r.start - x.maxLength
+	}
+	i := sort.Search(len(x.ranges), func(i int) bool { return x.ranges[i].start >= from })
+	for ; i < len(x.ranges) && x.ranges[i].start < r.start+r.length; i++ {
+		other := x.ranges[i]
+		start, end := other.start, other.start+other.length
+		if r.start > start {
+			start = r.start
+		}
+		if r.start+r.length < end {
+			end = r.start + r.length
+		}
+		if end > start {
+			receiver(other, end-start)
+		}
+	}
+}
+
+// Returns the ranges up to the specified size in which dest shares the physical extents of source
+func sharedRanges(source, dest *storage.FileInformation, size int64) []byteRange {
+	return rangesWhere(source, dest, size, func(sExtent, dExtent storage.Extent) bool {
+		return hasLocation(sExtent.Fragment) && hasLocation(dExtent.Fragment) && sExtent.Start == dExtent.Start
+	})
+}
+
+// Returns the size up to which the data of dest can be relinked to source. Unless both files have the same size this
+// is rounded down to the block size.
+func relinkSize(source, dest *storage.FileInformation, blockSize int64) int64 {
+	if source.Size == dest.Size {
+		return source.Size
+	}
+	size := source.Size
+	if dest.Size < size {
+		size = dest.Size
+	}
+	return size - size%blockSize
+}
+
+// Returns the ranges in which the copy can be relinked to the file after the file is defragmented, or false if the copy
+// shares data that can't be relinked, like data at another offset or in a partial last block
+func relinkRanges(file, copy *storage.FileInformation, blockSize int64) ([]byteRange, bool) {
+	var index physicalIndex
+	index.add(physicalRanges(file)...)
+	index.sort()
+	var overlap uint64
+	for _, r := range physicalRanges(copy) {
+		index.overlapping(r, func(other physicalRange, bytes uint64) {
+			overlap += bytes
+		})
+	}
+	ranges := sharedRanges(file, copy, relinkSize(file, copy, blockSize))
+	var shared uint64
+	for _, r := range ranges {
+		shared += uint64(r.length)
+	}
+	return ranges, shared == overlap
+}
+
+// Returns the number of bytes that the file shares according to the kernel, but not with any of the copies. These are
+// shared with files that were not scanned, like snapshots outside the given paths, which can't be relinked.
+func sharedOutside(file *storage.FileInformation, copies []*storage.FileInformation) uint64 {
+	var index physicalIndex
+	for _, copy := range copies {
+		index.add(physicalRanges(copy)...)
+	}
+	index.sort()
+	var outside uint64
+	shared := physicalRangesWhere(file, func(frag sys.Fragment) bool { return hasLocation(frag) && frag.Shared() })
+	for _, r := range shared {
+		// the parts of the range that are covered by the copies, which may overlap each other
+		var covered []physicalRange
+		index.overlapping(r, func(other physicalRange, bytes uint64) {
+			start := other.start
+			if start < r.start {
+				start = r.start
+			}
+			covered = append(covered, physicalRange{start: start, length: bytes})
+		})
+		sort.Slice(covered, func(i, j int) bool { return covered[i].start < covered[j].start })
+		end := r.start
+		var coveredBytes uint64
+		for _, c := range covered {
+			if c.start > end {
+				end = c.start
+			}
+			if c.start+c.length > end {
+				coveredBytes += c.start + c.length - end
+				end = c.start + c.length
+			}
+		}
+		outside += r.length - coveredBytes
+	}
+	return outside
+}
+
+// A fragmented file that is to be defragmented, with the files that share physical ranges with it
+type defragCandidate struct {
+	fs       *filesystem
+	file     *storage.FileInformation
+	decision defragDecision
+	copies   []*storage.FileInformation
+}
+
+// Returns the fragmented files of the filesystem that are to be defragmented, with their copies. The state is scanned
+// twice, first for the fragmented files and then for the files that share ranges with them, so only the ranges of the
+// fragmented files are kept in memory.
+func findCandidates(ctx context, fs *filesystem) []*defragCandidate {
+	ctx = ctx.on(fs)
+	var candidates []*defragCandidate
+	byPath := make(map[int32]*defragCandidate)
+	var index physicalIndex
+	ctx.state.ScanOnOffset(func(files []*storage.FileInformation) {
+		for _, file := range files {
+			if len(file.Fragments) <= 1 || ctx.interrupt.interrupted() {
+				continue
+			}
+			decision := ctx.defragDecision(file)
+			if !decision.defrag {
+				ctx.reportExemption(file, decision)
+				continue
+			}
+			candidate := &defragCandidate{fs: fs, file: file, decision: decision}
+			candidates = append(candidates, candidate)
+			byPath[file.Path] = candidate
+			index.add(physicalRanges(file)...)
+		}
+	})
+	if len(candidates) == 0 || ctx.interrupt.interrupted() {
+		return candidates
+	}
+	index.sort()
+	ctx.state.ScanOnOffset(func(files []*storage.FileInformation) {
+		for _, file := range files {
+			for _, r := range physicalRanges(file) {
+				index.overlapping(r, func(other physicalRange, bytes uint64) {
+					candidate := byPath[other.path]
+					// the ranges of a file are looked up one after the other, so it can only be the last copy
+					if last := len(candidate.copies) - 1; other.path == file.Path || last >= 0 && candidate.copies[last].Path == file.Path {
+						return
+					}
+					candidate.copies = append(candidate.copies, file)
+				})
+			}
+		}
+	})
+	return candidates
+}
+
+// Defragments the file of the candidate and relinks its copies to it. Returns true if the file is defragmented.
+func defragCopies(ctx context, candidate *defragCandidate, noact bool) bool {
+	file, decision := candidate.file, candidate.decision
+	fragcount := len(file.Fragments)
+	path := ctx.pathstore.FilePath(file.Path)
+
+	// the shared ranges must be determined before the defragmentation unshares them
+	var readOnly, unrelinkable []string
+	if !file.Writable(ctx.pathstore) {
+		readOnly = append(readOnly, path)
+	}
+	var ranges [][]byteRange
+	var shared int64
+	for _, copy := range candidate.copies {
+		copyPath := ctx.pathstore.FilePath(copy.Path)
+		copyRanges, ok := relinkRanges(file, copy, ctx.blockSize)
+		if !ok {
+			unrelinkable = append(unrelinkable, copyPath)
+		} else if !copy.Writable(ctx.pathstore) {
+			readOnly = append(readOnly, copyPath)
+		}
+		ranges = append(ranges, copyRanges)
+		for _, r := range copyRanges {
+			shared += r.length
+		}
+	}
+	if len(readOnly) > 0 {
+		log.Printf("File %s has %s, but will not be defragmented, %d of its copies are not writable: %v", path, decision.reason, len(readOnly), readOnly)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragNotWritable, Reason: decision.reason, Copies: len(candidate.copies), Blocking: readOnly})
+		return false
+	}
+	if len(unrelinkable) > 0 {
+		log.Printf("File %s has %s, but will not be defragmented, %d of its copies share data that can't be relinked: %v", path, decision.reason, len(unrelinkable), unrelinkable)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragSkipped, Reason: "copies share data at other offsets", Copies: len(candidate.copies), Blocking: unrelinkable})
+		return false
+	}
+	if outside := sharedOutside(file, candidate.copies); outside > 0 {
+		reason := fmt.Sprintf("shares %s with files outside the scanned paths", formatBytes(int64(outside)))
+		log.Printf("File %s has %s, but will not be defragmented, it %s", path, decision.reason, reason)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragSkipped, Reason: reason, Copies: len(candidate.copies)})
+		return false
+	}
+
+	if noact {
+		log.Printf("File %s has %s, but will not be defragmented because -noact option is specified", path, decision.reason)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragNoact, Reason: decision.reason, Copies: len(candidate.copies)})
+		return false
+	}
+
+	if shortage := ctx.reserve.check(path, file.Size); shortage != "" {
+		ctx.reportShortage(path, fragcount, decision, shortage)
+		return false
+	}
+
+	log.Printf("File %s has %s, starting defragmentation", path, decision.reason)
+	if ctx.cache != nil {
+		ctx.cache.Invalidate(file.Path)
+		for _, copy := range candidate.copies {
+			ctx.cache.Invalidate(copy.Path)
+		}
+	}
+	if err := defragFile(path, ctx.defrag); err != nil {
+		log.Printf("Defragmentation of %s failed: %v", path, err)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragFailed, Reason: decision.reason, Error: err.Error()})
+		return false
+	}
+	action := storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragDone, Reason: decision.reason, Copies: len(candidate.copies)}
+	if newFile, err := readFileMeta(file.Path, path); err != nil {
+		log.Printf("Error while reading the fragmentation table again: %v", err)
+	} else if newFile != nil {
+		action.FragmentsAfter = len(newFile.Fragments)
+		log.Printf("Number of fragments was %d and is now %d for file %s", fragcount, len(newFile.Fragments), path)
+	}
+	ctx.stats.Defragmented(action)
+
+	relinkCopies(ctx, path, candidate.copies, ranges, shared)
+	return true
+}
+
+// Relinks the given ranges of the copies to the defragmented file. This is not stopped when the run is interrupted,
+// because the copies don't share their data with the file until they are relinked.
+func relinkCopies(ctx context, path string, copies []*storage.FileInformation, ranges [][]byteRange, shared int64) {
+	if len(copies) == 0 {
+		return
+	}
+	filenames := make([]string, len(copies))
+	for i, copy := range copies {
+		filenames[i] = ctx.pathstore.FilePath(copy.Path)
+	}
+	log.Printf("Relinking %d copies of %s%s, %d shared bytes", len(copies), path, aliasInfo(ctx, copies), shared)
+	ctx.stats.Offered(shared, 0)
+	result := DedupRanges(path, filenames, ranges, uint64(ctx.blockSize), nil)
+	ctx.stats.Deduplicated(int64(result.bytesDeduped), result.dataDiffers, result.errors)
+}
+
+func defragPass(ctx context, noact bool) {
+	fmt.Printf("Pass 2 of 2, defragmenting files and relinking their copies\n")
+	var candidates []*defragCandidate
+	for _, fs := range ctx.fs.list {
+		candidates = append(candidates, findCandidates(ctx, fs)...)
+		if ctx.interrupt.interrupted() {
+			return
+		}
+	}
+	log.Printf("Found %d files to defragment", len(candidates))
+
+	// defragmentation is bound by the disk, so the files are processed one at a time
+	ctx.stats.StartDefragProgress(len(candidates))
+	// a copy of a defragmented file has other extents now, so it is not defragmented itself
+	relinked := make(map[int32]bool)
+	for _, candidate := range candidates {
+		if ctx.interrupt.interrupted() {
+			break
+		}
+		if !relinked[candidate.file.Path] && defragCopies(ctx.on(candidate.fs), candidate, noact) {
+			for _, copy := range candidate.copies {
+				relinked[copy.Path] = true
+			}
+		}
+		ctx.stats.Defragmenting(1)
+	}
+	ctx.stats.StopProgress()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSharedRanges(t *testing.T) {
+	source := fileWithFragments(40, 100, 10, 200, 10, 300, 20)
+	dest := fileWithFragments(40, 100, 10, 500, 10, 300, 20)
+
+	ranges := sharedRanges(source, dest, 40)
+	expected := []byteRange{{0, 10}, {20, 20}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, but was %v", expected, ranges)
+	}
+}
+
+func TestRelinkSizeAlignedToBlockSize(t *testing.T) {
+	if size := relinkSize(fileWithFragments(6000), fileWithFragments(6000), 4096); size != 6000 {
+		t.Errorf("Expected the full size for files of equal size, but was %d", size)
+	}
+	if size := relinkSize(fileWithFragments(9000), fileWithFragments(6000), 4096); size != 4096 {
+		t.Errorf("Expected the smallest size rounded down to the block size, but was %d", size)
+	}
+}
+
+func TestCopyFoundBySharedRange(t *testing.T) {
+	file := fileWithFragments(40, 100, 10, 200, 30)
+	file.Path = 1
+	// a snapshot of which the first extent was rewritten, so it has another first block than the file
+	snapshot := fileWithFragments(40, 900, 10, 200, 30)
+	other := fileWithFragments(40, 600, 40)
+
+	var index physicalIndex
+	index.add(physicalRanges(file)...)
+	index.sort()
+	found := func(copy *storage.FileInformation) (overlap uint64) {
+		for _, r := range physicalRanges(copy) {
+			index.overlapping(r, func(other physicalRange, bytes uint64) {
+				if other.path != file.Path {
+					t.Errorf("Expected a range of the file, but was %v", other)
+				}
+				overlap += bytes
+			})
+		}
+		return
+	}
+	if overlap := found(snapshot); overlap != 30 {
+		t.Errorf("Expected the snapshot to share 30 bytes, but was %d", overlap)
+	}
+	if overlap := found(other); overlap != 0 {
+		t.Errorf("Expected the other file to share nothing, but was %d", overlap)
+	}
+}
+
+func TestRelinkRangesOfCopy(t *testing.T) {
+	file := fileWithFragments(40, 100, 10, 200, 30)
+	snapshot := fileWithFragments(40, 900, 10, 200, 30)
+	ranges, ok := relinkRanges(file, snapshot, 10)
+	if expected := []byteRange{{10, 30}}; !ok || !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v to be relinkable, but was %v (%v)", expected, ranges, ok)
+	}
+
+	// a reflink of the data at another offset can't be relinked by deduplicating the same ranges
+	moved := fileWithFragments(40, 200, 30, 900, 10)
+	if _, ok := relinkRanges(file, moved, 10); ok {
+		t.Errorf("Expected data at another offset to be not relinkable")
+	}
+}
+
+func TestRelinkingNotInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := storage.NewProgressLogStats()
+	stats.Start()
+	defer stats.Stop()
+	// interrupted after the file has been defragmented
+	ctx := context{pathstore: storage.NewPathStorage(), stats: stats, links: newHardlinks(), blockSize: 4096,
+		interrupt: &interruption{signal: int32(syscall.SIGINT)}}
+
+	var copies []*storage.FileInformation
+	for _, name := range []string{"file", "copy"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, &storage.FileInformation{Path: addPath(ctx.pathstore, path), Size: 4096})
+	}
+	relinkCopies(ctx, filepath.Join(dir, "file"), copies[1:], [][]byteRange{{{0, 4096}}}, 4096)
+
+	// outside btrfs the request fails, but it must have been made
+	if report := stats.Report(); report.BytesDeduped+int64(report.DedupErrors+report.DataDiffers) == 0 {
+		t.Errorf("Expected the copy to be relinked although the run is interrupted")
+	}
+}
+
+func TestSharedOutsideScannedPaths(t *testing.T) {
+	file := fileWithFragments(40, 100, 10, 200, 30)
+	file.Fragments[1].Flags = sys.FIEMAP_EXTENT_SHARED
+	// two snapshots that each share a part of the second fragment, overlapping each other
+	first := fileWithFragments(40, 900, 10, 200, 20, 800, 10)
+	second := fileWithFragments(40, 900, 20, 210, 20)
+
+	if outside := sharedOutside(file, []*storage.FileInformation{first, second}); outside != 0 {
+		t.Errorf("Expected the shared data to be covered by the copies, but %d bytes were not", outside)
+	}
+	if outside := sharedOutside(file, []*storage.FileInformation{first}); outside != 10 {
+		t.Errorf("Expected 10 bytes to be shared outside the copies, but was %d", outside)
+	}
+	if outside := sharedOutside(file, nil); outside != 30 {
+		t.Errorf("Expected the shared fragment to be shared outside, but was %d", outside)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// maximum size of an extent in btrfs
+	maxExtentSize int64 = 128 * 1024 * 1024
+	// maximum size of the uncompressed data of a compressed extent
+	maxCompressedExtentSize int64 = 128 * 1024
+)
+
+// The properties of a file on which the defragmentation policies decide
+type defragFacts struct {
+	size      int64
+	fragments int
+	// number of bytes in compressed extents
+	compressed int64
+	// the file has the NOCOW attribute (chattr +C), so it is rewritten in place
+	nocow bool
+	// the file has the compress attribute (chattr +c), so all its data is compressed when it is rewritten
+	compress bool
+}
+
+func (f defragFacts) averageExtentSize() int64 {
+	if f.fragments == 0 {
+		return f.size
+	}
+	return f.size / int64(f.fragments)
+}
+
+// Returns the number of fragments the file needs with extents of the given size. Compressed extents can't be larger
+// than 128K.
+func (f defragFacts) fragmentsNeeded(extentSize int64) int {
+	compressed := f.compressed
+	if f.compress {
+		compressed = f.size
+	}
+	uncompressed := f.size - compressed
+	if uncompressed < 0 {
+		uncompressed = 0
+	}
+	compressedExtentSize := extentSize
+	if compressedExtentSize > maxCompressedExtentSize {
+		compressedExtentSize = maxCompressedExtentSize
+	}
+	needed := int((uncompressed+extentSize-1)/extentSize + (compressed+compressedExtentSize-1)/compressedExtentSize)
+	if needed < 1 {
+		return 1
+	}
+	return needed
+}
+
+// The decision of a defragmentation policy for a file, with the reason for the log and the report
+type defragDecision struct {
+	defrag bool
+	// the file has more fragments than allowed, but is exempted from defragmentation
+	exempted bool
+	reason   string
+}
+
+// Decides which files are defragmented, see defragPolicies
+type defragPolicy struct {
+	name        string
+	description string
+	// returns the number of fragments that is allowed for the file with the minimal average extent size given by -bpf
+	allowed func(facts defragFacts, extentSize int64) int
+}
+
+var defragPolicies = []defragPolicy{
+	{"bpf", "files with an average extent size of less than -bpf blocks", func(facts defragFacts, extentSize int64) int {
+		return facts.fragmentsNeeded(extentSize)
+	}},
+	// unlike bpf with a large -bpf, this doesn't depend on the block size, so it is the same on each filesystem
+	{"minimal", "files with more fragments than the minimum that btrfs needs for them with extents of 128M, regardless of -bpf", func(facts defragFacts, extentSize int64) int {
+		return facts.fragmentsNeeded(maxExtentSize)
+	}},
+}
+
+func defragPolicyNames() string {
+	names := make([]string, len(defragPolicies))
+	for i, policy := range defragPolicies {
+		names[i] = fmt.Sprintf("%s (%s)", policy.name, policy.description)
+	}
+	return strings.Join(names, ", ")
+}
+
+func defragPolicyByName(name string) (*defragPolicy, error) {
+	for i := range defragPolicies {
+		if defragPolicies[i].name == name {
+			return &defragPolicies[i], nil
+		}
+	}
+	return nil, errors.Errorf("unknown defragmentation policy '%s', supported policies are: %s", name, defragPolicyNames())
+}
+
+// Decides whether a file with the given facts is defragmented. Files with the NOCOW attribute are exempted, because
+// they are rewritten in place by the applications that use them, like databases and virtual machines, and thus
+// fragment again.
+func (p *defragPolicy) decide(facts defragFacts, extentSize int64) defragDecision {
+	allowed := p.allowed(facts, extentSize)
+	description := fmt.Sprintf("%d fragments while we want max %d (average extent size %s", facts.fragments, allowed, formatBytes(facts.averageExtentSize()))
+	if facts.compressed > 0 {
+		description += fmt.Sprintf(", %s compressed", formatBytes(facts.compressed))
+	}
+	if facts.compress {
+		description += ", compress attribute"
+	}
+	description += ")"
+	switch {
+	case facts.fragments <= allowed:
+		return defragDecision{reason: description}
+	case facts.nocow:
+		return defragDecision{exempted: true, reason: description + ", but the file has the NOCOW attribute"}
+	}
+	return defragDecision{defrag: true, reason: description}
+}
+
+// Returns the defragmentation facts of the fragments of the file, without the attributes
+func defragFactsOf(file *storage.FileInformation) defragFacts {
+	facts := defragFacts{size: file.Size, fragments: len(file.Fragments)}
+	for _, frag := range file.Fragments {
+		if frag.Encoded() {
+			facts.compressed += int64(frag.Length)
+		}
+	}
+	return facts
+}
+
+// Sets the facts of the NOCOW and compress attributes of the file
+func (f *defragFacts) readAttributes(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Unable to read the attributes of %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+	flags, err := sys.InodeFlags(file)
+	if err != nil {
+		log.Printf("Unable to read the attributes of %s: %v", path, err)
+		return
+	}
+	f.nocow = flags&sys.FS_NOCOW_FL != 0
+	f.compress = flags&sys.FS_COMPR_FL != 0
+}
+
+// Returns the decision of the defragmentation policy for the file. Nothing is defragmented without a policy.
+func (ctx context) defragDecision(file *storage.FileInformation) defragDecision {
+	if ctx.policy == nil || len(file.Fragments) <= 1 {
+		return defragDecision{}
+	}
+	facts := defragFactsOf(file)
+	extentSize := int64(ctx.minBpf) * ctx.blockSize
+	decision := ctx.policy.decide(facts, extentSize)
+	if decision.defrag {
+		// the attributes are only read for the files that would be defragmented
+		facts.readAttributes(ctx.pathstore.FilePath(file.Path))
+		decision = ctx.policy.decide(facts, extentSize)
+	}
+	return decision
+}
+
+// Logs and reports the decision if the file is exempted from defragmentation
+func (ctx context) reportExemption(file *storage.FileInformation, decision defragDecision) {
+	if !decision.exempted {
+		return
+	}
+	path := ctx.pathstore.FilePath(file.Path)
+	log.Printf("File %s has %s, so it will not be defragmented", path, decision.reason)
+	ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: len(file.Fragments), Result: storage.DefragSkipped, Reason: decision.reason})
+}
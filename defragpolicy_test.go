@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/sys"
+	"testing"
+)
+
+const mb = 1024 * 1024
+
+func policy(t *testing.T, name string) *defragPolicy {
+	policy, err := defragPolicyByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestBpfPolicyHonorsAverageExtentSize(t *testing.T) {
+	bpf := policy(t, "bpf")
+	// 4MB extents with -bpf 1024 and 4k blocks
+	extentSize := int64(1024 * 4096)
+
+	if decision := bpf.decide(defragFacts{size: 40 * mb, fragments: 10}, extentSize); decision.defrag {
+		t.Errorf("Expected a file with 4MB extents not to be defragmented: %s", decision.reason)
+	}
+	if decision := bpf.decide(defragFacts{size: 40 * mb, fragments: 11}, extentSize); !decision.defrag {
+		t.Errorf("Expected a file with an average extent size below 4MB to be defragmented: %s", decision.reason)
+	}
+	if decision := bpf.decide(defragFacts{size: 40 * mb, fragments: 11}, 256*4096); decision.defrag {
+		t.Errorf("Expected a file with 11 fragments to be allowed with -bpf 256: %s", decision.reason)
+	}
+	if decision := bpf.decide(defragFacts{size: 1000, fragments: 2}, extentSize); !decision.defrag {
+		t.Errorf("Expected a small file with 2 fragments to be defragmented: %s", decision.reason)
+	}
+}
+
+func TestMinimalPolicyIgnoresBpf(t *testing.T) {
+	minimal := policy(t, "minimal")
+	if decision := minimal.decide(defragFacts{size: 256 * mb, fragments: 2}, 4096); decision.defrag {
+		t.Errorf("Expected 2 fragments to be the minimum for 256MB: %s", decision.reason)
+	}
+	if decision := minimal.decide(defragFacts{size: 256 * mb, fragments: 3}, 1024*1024*4096); !decision.defrag {
+		t.Errorf("Expected more fragments than the minimum to be defragmented: %s", decision.reason)
+	}
+}
+
+func TestPolicyAllowsSmallCompressedExtents(t *testing.T) {
+	bpf := policy(t, "bpf")
+	// compressed extents are at most 128K, so 1MB of compressed data needs 8 fragments
+	facts := defragFacts{size: 5 * mb, fragments: 9, compressed: 1 * mb}
+	if decision := bpf.decide(facts, 4*mb); decision.defrag {
+		t.Errorf("Expected the compressed extents to be allowed: %s", decision.reason)
+	}
+	facts.fragments = 10
+	if decision := bpf.decide(facts, 4*mb); !decision.defrag {
+		t.Errorf("Expected a fragmented uncompressed part to be defragmented: %s", decision.reason)
+	}
+}
+
+func TestPolicyAllowsCompressAttribute(t *testing.T) {
+	bpf := policy(t, "bpf")
+	// the whole file is compressed when it is rewritten, so it needs 8 fragments of 128K
+	facts := defragFacts{size: 1 * mb, fragments: 8}
+	if decision := bpf.decide(facts, 4*mb); !decision.defrag {
+		t.Errorf("Expected an uncompressed file to be defragmented: %s", decision.reason)
+	}
+	facts.compress = true
+	if decision := bpf.decide(facts, 4*mb); decision.defrag {
+		t.Errorf("Expected a file with the compress attribute to be allowed 128K extents: %s", decision.reason)
+	}
+}
+
+func TestPolicyExemptsNocowFiles(t *testing.T) {
+	decision := policy(t, "bpf").decide(defragFacts{size: 40 * mb, fragments: 100, nocow: true}, 4*mb)
+	if decision.defrag || !decision.exempted {
+		t.Errorf("Expected a NOCOW file to be exempted, but was %+v", decision)
+	}
+}
+
+func TestDefragFactsOfCompressedFile(t *testing.T) {
+	file := fileWithFragments(3*mb, 100, 1*mb, 5000000, 128*1024)
+	file.Fragments[1].Flags = sys.FIEMAP_EXTENT_ENCODED
+	facts := defragFactsOf(file)
+	if facts.fragments != 2 || facts.compressed != 128*1024 || facts.averageExtentSize() != 1536*1024 {
+		t.Errorf("Unexpected facts %+v", facts)
+	}
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	if _, err := defragPolicyByName("never"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
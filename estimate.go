@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// number of groups with the largest savings that are listed, the totals include all groups
+	listedEstimates = 100
+)
+
+// The space that deduplication of a group of files would free, estimated from the fragmentation information
+type savingsEstimate struct {
+	path  string
+	files int
+	// unshared bytes on disk in the files other than the first one, extents referenced by several files counted once
+	bytes int64
+	// part of bytes that is stored in compressed extents, which may already be shared
+	compressed int64
+}
+
+// Collects the estimated savings of the candidate groups with the -noact option. Only the groups with the largest
+// savings are kept, so the memory use doesn't grow with the number of groups.
+type savingsEstimates struct {
+	lock       sync.Mutex
+	largest    estimateHeap
+	groups     int
+	total      int64
+	compressed int64
+}
+
+func (e *savingsEstimates) add(estimate savingsEstimate) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.groups++
+	e.total += estimate.bytes
+	e.compressed += estimate.compressed
+	if len(e.largest) < listedEstimates {
+		heap.Push(&e.largest, estimate)
+	} else if estimate.bytes > e.largest[0].bytes {
+		e.largest[0] = estimate
+		heap.Fix(&e.largest, 0)
+	}
+}
+
+// Prints the estimate of the largest groups, sorted by the savings, and the total of all groups
+func (e *savingsEstimates) print(w io.Writer) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	largest := append([]savingsEstimate(nil), e.largest...)
+	sort.SliceStable(largest, func(i, j int) bool {
+		return largest[i].bytes > largest[j].bytes
+	})
+	if len(largest) < e.groups {
+		fmt.Fprintf(w, "Estimated savings of the %d groups with the largest savings:\n", len(largest))
+	} else {
+		fmt.Fprintf(w, "Estimated savings per group:\n")
+	}
+	for _, group := range largest {
+		fmt.Fprintf(w, "%10s  %s and %d other files\n", formatBytes(group.bytes), group.path, group.files-1)
+	}
+	fmt.Fprintf(w, "Estimated total savings: %s (%d bytes) in %d groups, of which %s in compressed extents that may already be shared\n",
+		formatBytes(e.total), e.total, e.groups, formatBytes(e.compressed))
+}
+
+// Min-heap of estimates on their savings, so the smallest of the largest groups can be replaced
+type estimateHeap []savingsEstimate
+
+func (h estimateHeap) Len() int            { return len(h) }
+func (h estimateHeap) Less(i, j int) bool  { return h[i].bytes < h[j].bytes }
+func (h estimateHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *estimateHeap) Push(x interface{}) { *h = append(*h, x.(savingsEstimate)) }
+func (h *estimateHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Returns the number of bytes on disk in the given ranges of the destinations, and the part of it in encoded extents.
+// Destinations that reference the same extents, like snapshots of the same old version, free these extents only once, so
+// each physical range is counted once. Data of which the location is unknown is always counted.
+func distinctBytes(dests []*storage.FileInformation, ranges [][]byteRange) (bytes, encoded int64) {
+	type piece struct {
+		start, end uint64
+		encoded    bool
+	}
+	var pieces []piece
+	for i, dest := range dests {
+		cursor := storage.NewExtentCursor(dest)
+		for _, r := range ranges[i] {
+			for offset := r.offset; offset < r.offset+r.length; {
+				extent := cursor.At(offset)
+				length := int64(extent.Length)
+				if remaining := r.offset + r.length - offset; length == 0 || remaining < length {
+					length = remaining
+				}
+				if hasLocation(extent.Fragment) {
+					pieces = append(pieces, piece{extent.Start, extent.Start + uint64(length), extent.Fragment.Encoded()})
+				} else {
+					bytes += length
+				}
+				offset += length
+			}
+		}
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].start < pieces[j].start })
+	var end uint64
+	for _, p := range pieces {
+		if p.start > end {
+			end = p.start
+		}
+		if p.end > end {
+			bytes += int64(p.end - end)
+			if p.encoded {
+				encoded += int64(p.end - end)
+			}
+			end = p.end
+		}
+	}
+	return bytes, encoded
+}
+
+// Formats the number of bytes with a binary unit
+func formatBytes(bytes int64) string {
+	const units = "KMGTPE"
+	if bytes < 1024 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes)
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[unit])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{0: "0B", 1023: "1023B", 1024: "1.0KiB", 1536: "1.5KiB", 5 << 30: "5.0GiB"}
+	for value, expected := range cases {
+		if formatted := formatBytes(value); formatted != expected {
+			t.Errorf("Expected %s for %d, but was %s", expected, value, formatted)
+		}
+	}
+}
+
+func TestEstimatesSortedBySavings(t *testing.T) {
+	var estimates savingsEstimates
+	estimates.add(savingsEstimate{path: "/small", files: 2, bytes: 1024})
+	estimates.add(savingsEstimate{path: "/large", files: 3, bytes: 4096, compressed: 1024})
+	var out bytes.Buffer
+	estimates.print(&out)
+
+	lines := strings.Split(out.String(), "\n")
+	if !strings.Contains(lines[1], "/large and 2 other files") || !strings.Contains(lines[2], "/small and 1 other files") {
+		t.Errorf("Expected groups sorted by savings, but was:\n%s", out.String())
+	}
+	if !strings.Contains(lines[3], "5.0KiB (5120 bytes) in 2 groups, of which 1.0KiB") {
+		t.Errorf("Expected total of both groups, but was: %s", lines[3])
+	}
+}
+
+func TestEstimateCountsSharedDestinationsOnce(t *testing.T) {
+	source := fileWithFragments(40, 100, 40)
+	// two snapshots of the same old version reference the same extent, which is freed only once
+	first := fileWithFragments(40, 500, 40)
+	second := fileWithFragments(40, 500, 40)
+	other := fileWithFragments(40, 500, 20, 700, 20)
+	dests := []*storage.FileInformation{first, second, other}
+	ranges := make([][]byteRange, len(dests))
+	for i, dest := range dests {
+		ranges[i] = unsharedRanges(source, dest, 40)
+	}
+
+	if savings, _ := distinctBytes(dests, ranges); savings != 60 {
+		t.Errorf("Expected the shared extent to be counted once, but the savings were %d", savings)
+	}
+}
+
+func TestEstimatesListOnlyLargestGroups(t *testing.T) {
+	var estimates savingsEstimates
+	for i := 1; i <= listedEstimates+10; i++ {
+		estimates.add(savingsEstimate{path: fmt.Sprintf("/%d", i), files: 2, bytes: int64(i)})
+	}
+	if len(estimates.largest) != listedEstimates {
+		t.Errorf("Expected %d groups to be kept, but was %d", listedEstimates, len(estimates.largest))
+	}
+	var out bytes.Buffer
+	estimates.print(&out)
+	lines := strings.Split(out.String(), "\n")
+	if !strings.Contains(lines[1], "/110 and") || !strings.Contains(lines[listedEstimates], "/11 and") {
+		t.Errorf("Expected the largest groups in order, but was %s ... %s", lines[1], lines[listedEstimates])
+	}
+	if !strings.Contains(lines[listedEstimates+1], "in 110 groups") {
+		t.Errorf("Expected the total of all groups, but was: %s", lines[listedEstimates+1])
+	}
+}
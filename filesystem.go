@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"log"
+	"os"
+	"syscall"
+)
+
+// A filesystem with files to deduplicate. Files can only be deduplicated with files on the same filesystem, so each
+// filesystem has its own state and is processed independently.
+type filesystem struct {
+	id [16]byte
+	// the size of the blocks in which the files are allocated, deduplication must be aligned to this size
+	sectorSize int64
+	state      storage.DedupInterface
+	// index in the list of filesystems
+	index uint16
+}
+
+func (fs *filesystem) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", fs.id[0:4], fs.id[4:6], fs.id[6:8], fs.id[8:10], fs.id[10:16])
+}
+
+// Keeps track of the filesystems of the collected files
+type filesystems struct {
+	newState func() storage.DedupInterface
+	// if true, the files of a root must be on the same filesystem as the root
+	xdev bool
+	root *filesystem
+	// per device the filesystem, nil if it can not be used. Each btrfs subvolume has its own device number.
+	devices map[uint64]*filesystem
+	byID    map[[16]byte]*filesystem
+	list    []*filesystem
+	// per file number the index of its filesystem in list
+	files []uint16
+}
+
+func newFilesystems(xdev bool, newState func() storage.DedupInterface) *filesystems {
+	return &filesystems{newState: newState, xdev: xdev, devices: make(map[uint64]*filesystem), byID: make(map[[16]byte]*filesystem)}
+}
+
+// Returns the filesystem of the file at path, of which fi is the result of os.Lstat. Returns nil if the filesystem
+// can not be determined.
+func (f *filesystems) of(path string, fi os.FileInfo) *filesystem {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	device := uint64(stat.Dev)
+	if fs, ok := f.devices[device]; ok {
+		return fs
+	}
+	fs := f.lookup(path)
+	f.devices[device] = fs
+	return fs
+}
+
+func (f *filesystems) lookup(path string) *filesystem {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Unable to determine the filesystem of %s: %v", path, err)
+		return nil
+	}
+	defer file.Close()
+	info, err := sys.FilesystemInfo(file)
+	if err != nil {
+		log.Printf("Unable to determine the filesystem of %s: %v", path, err)
+		return nil
+	}
+	if fs, ok := f.byID[info.FSID]; ok {
+		return fs
+	}
+	if len(f.list) > int(^uint16(0)) {
+		log.Printf("Skipping %s, too many filesystems", path)
+		return nil
+	}
+	fs := f.add(info.FSID, int64(info.SectorSize))
+	log.Printf("Found filesystem %s with sector size %d at %s", fs, fs.sectorSize, path)
+	return fs
+}
+
+// Adds a filesystem with a new state
+func (f *filesystems) add(id [16]byte, sectorSize int64) *filesystem {
+	fs := &filesystem{id: id, sectorSize: sectorSize, state: f.newState(), index: uint16(len(f.list))}
+	f.byID[id] = fs
+	f.list = append(f.list, fs)
+	return fs
+}
+
+// Sets the root of which the files are collected next
+func (f *filesystems) enterRoot(path string, fi os.FileInfo) {
+	f.root = f.of(path, fi)
+}
+
+// Allows files of all filesystems to be collected
+func (f *filesystems) leaveRoot() {
+	f.root = nil
+}
+
+// Returns the filesystem of the file if its files can be collected, nil otherwise
+func (f *filesystems) accept(path string, fi os.FileInfo) *filesystem {
+	fs := f.of(path, fi)
+	if fs != nil && f.xdev && f.root != nil && fs != f.root {
+		if fi.IsDir() {
+			log.Printf("Skipping %s, it is on another filesystem", path)
+		}
+		return nil
+	}
+	return fs
+}
+
+// Registers the filesystem of a file
+func (f *filesystems) addFile(filenr int32, fs *filesystem) {
+	for int(filenr) >= len(f.files) {
+		f.files = append(f.files, 0)
+	}
+	f.files[filenr] = fs.index
+}
+
+// Returns the filesystem of the file with the given number
+func (f *filesystems) ofFile(filenr int32) *filesystem {
+	return f.list[f.files[filenr]]
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// name of the optional file with rules for a directory and its subdirectories
+	ignoreFileName = ".btrdedupignore"
+)
+
+// A condition of a rule. Conditions other than path patterns only match regular files.
+type condition interface {
+	// fi is nil for a directory of which only the path is known
+	match(path string, isDir bool, fi os.FileInfo) bool
+}
+
+// A line of the filter language. A rule matches if all its conditions match, the last matching rule decides whether
+// a file is included or excluded.
+type rule struct {
+	text       string
+	include    bool
+	dirOnly    bool
+	conditions []condition
+}
+
+func (r *rule) match(path string, isDir bool, fi os.FileInfo) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	for _, c := range r.conditions {
+		if !c.match(path, isDir, fi) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decides which files and directories are scanned, based on the rules from the command line and the rules files, and
+// optionally on the rules in the ignore file of each directory
+type filter struct {
+	rules       []rule
+	ignoreFiles bool
+	// working directory, to match relative paths against absolute patterns
+	cwd string
+	// rules from the ignore file per directory, nil if the directory has no ignore file
+	dirRules map[string][]rule
+}
+
+func newFilter(ignoreFiles bool) *filter {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Printf("Unable to get the working directory: %v", err)
+	}
+	return &filter{ignoreFiles: ignoreFiles, cwd: cwd, dirRules: make(map[string][]rule)}
+}
+
+// Adds a rule, include negates the rule like a leading '!' does
+func (f *filter) add(text string, include bool) error {
+	r, err := parseRule(text, "")
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		r.include = r.include != include
+		f.rules = append(f.rules, *r)
+	}
+	return nil
+}
+
+// Adds the rules from the file
+func (f *filter) load(name string) error {
+	rules, err := readRules(name, "")
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, rules...)
+	return nil
+}
+
+// Returns true if the file or directory is excluded. The parent directories are assumed not to be excluded, which is
+// the case when the tree is walked from the root.
+func (f *filter) excluded(path string, fi os.FileInfo) bool {
+	path = f.absolute(path)
+	return f.excludedAbsolute(path, fi.IsDir(), fi)
+}
+
+// Returns true if the file, or any of its parent directories, is excluded
+func (f *filter) excludedWithParents(path string, fi os.FileInfo) bool {
+	path = f.absolute(path)
+	var dirs []string
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if f.excludedAbsolute(dirs[i], true, nil) {
+			return true
+		}
+	}
+	return f.excludedAbsolute(path, fi.IsDir(), fi)
+}
+
+func (f *filter) excludedAbsolute(path string, isDir bool, fi os.FileInfo) bool {
+	excluded := false
+	decide := func(rules []rule) {
+		for i := range rules {
+			if rules[i].match(path, isDir, fi) {
+				excluded = !rules[i].include
+			}
+		}
+	}
+	decide(f.rules)
+	if f.ignoreFiles {
+		var dirs []string
+		for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+			dirs = append(dirs, dir)
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			decide(f.rulesOfDir(dirs[i]))
+		}
+	}
+	return excluded
+}
+
+func (f *filter) absolute(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(f.cwd, path)
+}
+
+// Returns the rules from the ignore file in the directory, the rules are read once
+func (f *filter) rulesOfDir(dir string) []rule {
+	if rules, ok := f.dirRules[dir]; ok {
+		return rules
+	}
+	rules, err := readRules(filepath.Join(dir, ignoreFileName), dir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		log.Printf("Error while reading the ignore file in %s: %v", dir, err)
+	}
+	f.dirRules[dir] = rules
+	return rules
+}
+
+// Reads the rules from a file, patterns with a slash are relative to base if it is not empty. Invalid rules in an
+// ignore file are skipped.
+func readRules(name string, base string) ([]rule, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open rules file failed")
+	}
+	defer file.Close()
+	var rules []rule
+	scanner := bufio.NewScanner(file)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		r, err := parseRule(scanner.Text(), base)
+		if err != nil {
+			if base == "" {
+				return nil, errors.Wrapf(err, "%s:%d", name, lineNr)
+			}
+			log.Printf("Skipping invalid rule at %s:%d: %v", name, lineNr, err)
+			continue
+		}
+		if r != nil {
+			rules = append(rules, *r)
+		}
+	}
+	return rules, errors.Wrapf(scanner.Err(), "reading %s failed", name)
+}
+
+// Parses a rule. Returns nil for empty lines and comments.
+func parseRule(text string, base string) (*rule, error) {
+	line := strings.TrimSpace(text)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	r := &rule{text: text}
+	if strings.HasPrefix(line, "!") {
+		r.include = true
+		line = line[1:]
+	}
+	for _, token := range splitConditions(line) {
+		c, dirOnly, err := parseCondition(token, base)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule '%s'", text)
+		}
+		r.dirOnly = r.dirOnly || dirOnly
+		r.conditions = append(r.conditions, c)
+	}
+	if len(r.conditions) == 0 {
+		return nil, errors.Errorf("invalid rule '%s', no conditions", text)
+	}
+	return r, nil
+}
+
+// Splits the conditions of a rule on whitespace, a backslash escapes the next character
+func splitConditions(line string) []string {
+	var tokens []string
+	var token strings.Builder
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			if c != ' ' && c != '\t' && c != '!' && c != '#' {
+				token.WriteRune('\\')
+			}
+			token.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ' ' || c == '\t':
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(c)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// Parses a condition, returns true if the condition only matches directories
+func parseCondition(token string, base string) (condition, bool, error) {
+	kind, value := "glob", token
+	if i := strings.Index(token, ":"); i > 0 {
+		switch token[:i] {
+		case "glob", "re", "size", "mtime", "ctime", "owner", "ext":
+			kind, value = token[:i], token[i+1:]
+		}
+	}
+	switch kind {
+	case "re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, false, err
+		}
+		return regexCondition{re}, false, nil
+	case "size":
+		c, err := parseSizeCondition(value)
+		return c, false, err
+	case "mtime", "ctime":
+		c, err := parseAgeCondition(value, kind == "ctime")
+		return c, false, err
+	case "owner":
+		c, err := parseOwnerCondition(value)
+		return c, false, err
+	case "ext":
+		return parseExtensionCondition(value), false, nil
+	default:
+		return parseGlobCondition(value, base)
+	}
+}
+
+// Matches the path against a glob pattern, where '**' matches any number of directories. A pattern without a slash is
+// matched against the name of the file, a pattern with a slash against the path relative to the base directory. Without
+// base directory, patterns that start with a slash are matched against the absolute path and other patterns against
+// any trailing part of the path.
+type globCondition struct {
+	pattern  string
+	segments []string
+	base     string
+	nameOnly bool
+}
+
+func parseGlobCondition(pattern string, base string) (condition, bool, error) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	if pattern == "" {
+		return nil, false, errors.New("empty pattern")
+	}
+	c := globCondition{pattern: pattern, base: base}
+	if !strings.Contains(pattern, "/") {
+		c.nameOnly = true
+	} else if strings.HasPrefix(pattern, "/") || base != "" {
+		c.segments = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	} else {
+		c.segments = append([]string{"**"}, strings.Split(pattern, "/")...)
+	}
+	for _, segment := range append(c.segments, pattern) {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return nil, false, errors.Wrapf(err, "invalid pattern '%s'", pattern)
+		}
+	}
+	return c, dirOnly, nil
+}
+
+func (c globCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	if c.nameOnly {
+		ok, _ := filepath.Match(c.pattern, filepath.Base(path))
+		return ok
+	}
+	relative := path
+	if c.base != "" {
+		if !strings.HasPrefix(path, c.base+"/") {
+			return false
+		}
+		relative = path[len(c.base)+1:]
+	}
+	return matchSegments(c.segments, strings.Split(strings.TrimPrefix(relative, "/"), "/"))
+}
+
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// Matches the absolute path against a regular expression
+type regexCondition struct {
+	re *regexp.Regexp
+}
+
+func (c regexCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	return c.re.MatchString(path)
+}
+
+// Compares a value of a regular file with a threshold
+type comparison struct {
+	operator  string
+	threshold int64
+}
+
+func parseComparison(value string) (comparison, string, error) {
+	for _, operator := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, operator) {
+			return comparison{operator: operator}, value[len(operator):], nil
+		}
+	}
+	return comparison{}, "", errors.Errorf("'%s' does not start with one of >, >=, <, <= or =", value)
+}
+
+func (c comparison) compare(value int64) bool {
+	switch c.operator {
+	case ">":
+		return value > c.threshold
+	case ">=":
+		return value >= c.threshold
+	case "<":
+		return value < c.threshold
+	case "<=":
+		return value <= c.threshold
+	default:
+		return value == c.threshold
+	}
+}
+
+// Matches regular files of which the size compares to the threshold, like size:>1M
+type sizeCondition struct {
+	comparison
+}
+
+var sizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+func parseSizeCondition(value string) (condition, error) {
+	c, size, err := parseComparison(value)
+	if err != nil {
+		return nil, err
+	}
+	c.threshold, err = parseSize(size)
+	return sizeCondition{c}, err
+}
+
+// Parses a size with an optional binary unit, like 4k, 1M or 2GiB
+func parseSize(value string) (int64, error) {
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+	digits := strings.TrimRight(upper, "KMGT")
+	multiplier, ok := sizeUnits[upper[len(digits):]]
+	number, err := strconv.ParseInt(digits, 10, 64)
+	if !ok || err != nil || number < 0 {
+		return 0, errors.Errorf("invalid size '%s'", value)
+	}
+	return number * multiplier, nil
+}
+
+func (c sizeCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	return fi != nil && fi.Mode().IsRegular() && c.compare(fi.Size())
+}
+
+// Matches regular files of which the age of the modification or change time compares to the threshold, like
+// mtime:>30d for files that are modified more than 30 days ago
+type ageCondition struct {
+	comparison
+	ctime bool
+	now   time.Time
+}
+
+var durationUnits = map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+
+func parseAgeCondition(value string, ctime bool) (condition, error) {
+	c, age, err := parseComparison(value)
+	if err != nil {
+		return nil, err
+	}
+	if age == "" {
+		return nil, errors.New("missing age")
+	}
+	unit, ok := durationUnits[age[len(age)-1]]
+	number, err := strconv.ParseInt(age[:len(age)-1], 10, 64)
+	if !ok || err != nil {
+		return nil, errors.Errorf("invalid age '%s', use a number with one of the units s, m, h, d or w", age)
+	}
+	c.threshold = int64(time.Duration(number) * unit)
+	return ageCondition{comparison: c, ctime: ctime, now: time.Now()}, nil
+}
+
+func (c ageCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	t := fi.ModTime()
+	if c.ctime {
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false
+		}
+		t = time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
+	}
+	return c.compare(int64(c.now.Sub(t)))
+}
+
+// Matches regular files that are owned by the user, given by name or uid
+type ownerCondition struct {
+	uid uint32
+}
+
+func parseOwnerCondition(value string) (condition, error) {
+	uid, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		u, lookupErr := user.Lookup(value)
+		if lookupErr != nil {
+			return nil, errors.Wrapf(lookupErr, "unknown owner '%s'", value)
+		}
+		uid, err = strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("unsupported uid '%s' of owner '%s'", u.Uid, value)
+		}
+	}
+	return ownerCondition{uint32(uid)}, nil
+}
+
+func (c ownerCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Uid == c.uid
+}
+
+// Matches regular files with one of the extensions, case insensitive, like ext:iso,img
+type extensionCondition struct {
+	extensions map[string]bool
+}
+
+func parseExtensionCondition(value string) condition {
+	c := extensionCondition{make(map[string]bool)}
+	for _, ext := range strings.Split(value, ",") {
+		c.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	return c
+}
+
+func (c extensionCondition) match(path string, isDir bool, fi os.FileInfo) bool {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return c.extensions[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))]
+}
+
+// Command line option that adds rules to the filter, in the order in which the options are given
+type ruleOption struct {
+	kind string
+	args *[]ruleArg
+}
+
+type ruleArg struct {
+	kind  string
+	value string
+}
+
+func (o ruleOption) String() string {
+	return ""
+}
+
+func (o ruleOption) Set(value string) error {
+	*o.args = append(*o.args, ruleArg{o.kind, value})
+	return nil
+}
+
+// Creates the filter with the rules from the options
+func createFilter(args []ruleArg, ignoreFiles bool) (*filter, error) {
+	f := newFilter(ignoreFiles)
+	for _, arg := range args {
+		var err error
+		switch arg.kind {
+		case "rules":
+			err = f.load(arg.value)
+		default:
+			err = f.add(arg.value, arg.kind == "include")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// file information for the filter tests
+type testFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi testFileInfo) IsDir() bool        { return fi.dir }
+func (fi testFileInfo) Sys() interface{}   { return nil }
+func (fi testFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir
+	}
+	return 0
+}
+
+func testFilter(t *testing.T, rules ...string) *filter {
+	f := newFilter(false)
+	for _, r := range rules {
+		if err := f.add(r, false); err != nil {
+			t.Fatalf("Unexpected error for rule %s: %v", r, err)
+		}
+	}
+	return f
+}
+
+func assertExcluded(t *testing.T, f *filter, path string, fi os.FileInfo, expected bool) {
+	if excluded := f.excluded(path, fi); excluded != expected {
+		t.Errorf("Expected excluded=%v for %s, but was %v", expected, path, excluded)
+	}
+}
+
+func TestFilterGlobs(t *testing.T) {
+	f := testFilter(t, "/var/lib/docker", "*.tmp", "cache/", "logs/**/*.gz")
+	file := testFileInfo{size: 10}
+	dir := testFileInfo{dir: true}
+
+	assertExcluded(t, f, "/var/lib/docker", dir, true)
+	assertExcluded(t, f, "/var/lib/docker2", dir, false)
+	assertExcluded(t, f, "/data/x.tmp", file, true)
+	assertExcluded(t, f, "/data/cache", dir, true)
+	assertExcluded(t, f, "/data/cache", file, false)
+	assertExcluded(t, f, "/data/logs/a/b/old.gz", file, true)
+	assertExcluded(t, f, "/data/logs/old.gz", file, true)
+	assertExcluded(t, f, "/data/old.gz", file, false)
+}
+
+func TestFilterLastMatchingRuleWins(t *testing.T) {
+	f := testFilter(t, "*.iso", "!/data/keep/*.iso")
+	file := testFileInfo{size: 10}
+
+	assertExcluded(t, f, "/data/other/a.iso", file, true)
+	assertExcluded(t, f, "/data/keep/a.iso", file, false)
+}
+
+func TestFilterFileConditions(t *testing.T) {
+	f := testFilter(t, "size:<1M", "ext:ISO,img size:>=4G", `re:/db/.*\.wal$`, "mtime:<1d")
+	old := time.Now().Add(-48 * time.Hour)
+
+	assertExcluded(t, f, "/data/small", testFileInfo{size: 1000, modTime: old}, true)
+	assertExcluded(t, f, "/data/large", testFileInfo{size: 2 << 20, modTime: old}, false)
+	assertExcluded(t, f, "/data/huge.iso", testFileInfo{size: 5 << 30, modTime: old}, true)
+	assertExcluded(t, f, "/data/huge.tar", testFileInfo{size: 5 << 30, modTime: old}, false)
+	assertExcluded(t, f, "/data/db/0001.wal", testFileInfo{size: 2 << 20, modTime: old}, true)
+	assertExcluded(t, f, "/data/recent", testFileInfo{size: 2 << 20, modTime: time.Now()}, true)
+	// file conditions never match directories
+	assertExcluded(t, f, "/data/dir", testFileInfo{dir: true, modTime: time.Now()}, false)
+}
+
+func TestFilterInvalidRules(t *testing.T) {
+	for _, r := range []string{"size:1M", "size:>1X", "mtime:>3y", "re:(", "owner:no-such-user-exists"} {
+		if err := newFilter(false).add(r, false); err == nil {
+			t.Errorf("Expected an error for rule %s", r)
+		}
+	}
+}
+
+func TestFilterIgnoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	rules := "# comment\n*.log\nb/*.dat\nb/c/\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", ignoreFileName), []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFilter(true)
+	file := testFileInfo{size: 10}
+
+	assertExcluded(t, f, filepath.Join(dir, "a", "x.log"), file, true)
+	assertExcluded(t, f, filepath.Join(dir, "a", "b", "x.dat"), file, true)
+	assertExcluded(t, f, filepath.Join(dir, "a", "x.dat"), file, false)
+	assertExcluded(t, f, filepath.Join(dir, "x.log"), file, false)
+	if !f.excludedWithParents(filepath.Join(dir, "a", "b", "c", "y.dat"), file) {
+		t.Errorf("Expected file in excluded subtree to be excluded")
+	}
+}
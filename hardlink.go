@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+type inodeKey struct {
+	device uint64
+	inode  uint64
+}
+
+// Keeps track of files with multiple hard links, so that each inode is only processed once. The other names of an
+// inode are kept as aliases of the first name that is found.
+type hardlinks struct {
+	inodes  map[inodeKey]int32
+	aliases map[int32][]string
+	count   int
+}
+
+func newHardlinks() *hardlinks {
+	return &hardlinks{inodes: make(map[inodeKey]int32), aliases: make(map[int32][]string)}
+}
+
+func linkKey(fi os.FileInfo) (inodeKey, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return inodeKey{}, false
+	}
+	return inodeKey{uint64(stat.Dev), stat.Ino}, true
+}
+
+// Returns true if the inode of the file was already added with another name, in which case the path is recorded as
+// an alias of that file
+func (h *hardlinks) alias(path string, fi os.FileInfo) bool {
+	key, ok := linkKey(fi)
+	if !ok {
+		return false
+	}
+	filenr, ok := h.inodes[key]
+	if !ok {
+		return false
+	}
+	h.aliases[filenr] = append(h.aliases[filenr], path)
+	h.count++
+	return true
+}
+
+// Registers the file number of the first name of the inode of the file
+func (h *hardlinks) register(filenr int32, fi os.FileInfo) {
+	if key, ok := linkKey(fi); ok {
+		h.inodes[key] = filenr
+	}
+}
+
+// Returns the other names of the file
+func (h *hardlinks) aliasesOf(filenr int32) []string {
+	return h.aliases[filenr]
+}
+
+func (h *hardlinks) logSummary() {
+	if h.count > 0 {
+		log.Printf("Skipped %d hard links to %d files that are already found with another name", h.count, len(h.aliases))
+	}
+}
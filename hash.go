@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/pkg/errors"
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+	"strings"
+)
+
+// Hash algorithm used for the checksums of the first block and of the chunks in the verification pass
+type hashAlgorithm struct {
+	name string
+	// size of the digest in bytes, at most storage.MaxHashSize
+	size int
+	sum  func(data []byte) [storage.MaxHashSize]byte
+}
+
+func digest(d []byte) (csum [storage.MaxHashSize]byte) {
+	copy(csum[:], d)
+	return
+}
+
+var hashAlgorithms = []hashAlgorithm{
+	{"xxh3", 16, func(data []byte) [storage.MaxHashSize]byte {
+		d := xxh3.Hash128(data).Bytes()
+		return digest(d[:])
+	}},
+	{"blake3", 32, func(data []byte) [storage.MaxHashSize]byte {
+		d := blake3.Sum256(data)
+		return digest(d[:])
+	}},
+	{"sha256", 32, func(data []byte) [storage.MaxHashSize]byte {
+		d := sha256.Sum256(data)
+		return digest(d[:])
+	}},
+	{"md5", 16, func(data []byte) [storage.MaxHashSize]byte {
+		d := md5.Sum(data)
+		return digest(d[:])
+	}},
+}
+
+func hashAlgorithmNames() string {
+	names := make([]string, len(hashAlgorithms))
+	for i, algorithm := range hashAlgorithms {
+		names[i] = algorithm.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func hashAlgorithmByName(name string) (*hashAlgorithm, error) {
+	for i := range hashAlgorithms {
+		if hashAlgorithms[i].name == name {
+			return &hashAlgorithms[i], nil
+		}
+	}
+	return nil, errors.Errorf("unknown hash algorithm '%s', supported algorithms are: %s", name, hashAlgorithmNames())
+}
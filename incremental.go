@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// A subvolume that is scanned incrementally, with the generation it had when the scan started
+type scannedSubvolume struct {
+	path       string
+	generation uint64
+}
+
+// Files found during incremental discovery, the checksums are used to find partners in the cache
+type newFiles struct {
+	paths map[string]bool
+	csums map[[storage.MaxHashSize]byte]bool
+}
+
+// Adds the file to the path storage if it is applicable, returns the filesystem of the file if it is added and nil
+// otherwise
+func (n *newFiles) add(ctx context, path string, minSize int) *filesystem {
+	if n.paths[path] {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		log.Printf("Error using os.Lstat on file %s: %v", path, err)
+		return nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	fs := ctx.fs.accept(path, fi)
+	if fs == nil {
+		ctx.stats.FileSkipped(filesystemSkipReason(ctx, path, fi))
+		return nil
+	}
+	if fi.Size()/fs.sectorSize < int64(minSize) {
+		ctx.stats.FileSkipped(storage.SkippedTooSmall)
+		return nil
+	}
+	if ctx.filter.excludedWithParents(path, fi) {
+		ctx.stats.FileSkipped(storage.SkippedExcluded)
+		return nil
+	}
+	n.paths[path] = true
+	if ctx.links.alias(path, fi) {
+		ctx.stats.FileSkipped(storage.SkippedHardLink)
+		return nil
+	}
+	filenr := ctx.pathstore.AddFile(-1, path)
+	ctx.links.register(filenr, fi)
+	ctx.fs.addFile(filenr, fs)
+	return fs
+}
+
+// Returns the subvolume of which root is the root directory and all subvolumes nested in it
+func subvolumesOf(root *os.File) ([]sys.Subvolume, error) {
+	id, err := sys.SubvolumeID(root)
+	if err != nil {
+		return nil, err
+	}
+	nested, err := sys.NestedSubvolumes(root, id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]sys.Subvolume{{ID: id, Path: ""}}, nested...), nil
+}
+
+func isSubvolumeRoot(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Ino == sys.FirstFreeObjectID
+}
+
+// Adds the files in the subvolume that have extents with a generation of at least since
+func collectNewFilesInSubvolume(ctx context, root *os.File, subvolume sys.Subvolume, path string, since uint64, found *newFiles, minSize int) error {
+	inodes, err := sys.FindNew(root, subvolume.ID, since)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d inodes with new extents since generation %d in subvolume %s", len(inodes), since, path)
+	for _, inode := range inodes {
+		if ctx.interrupt.interrupted() {
+			return nil
+		}
+		relative, err := sys.InodePath(root, subvolume.ID, inode)
+		if err != nil {
+			log.Printf("Unable to find the path of inode %d in subvolume %s: %v", inode, path, err)
+			continue
+		}
+		file := filepath.Join(path, relative)
+		if fs := found.add(ctx, file, minSize); fs != nil {
+			if csum, err := readChecksum(ctx.hash, file, fs.sectorSize); err == nil {
+				found.csums[*csum] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Collects the files with extents that are new since the last run, or since the given transaction id if since is not
+// negative, together with the cached files that have the same first block. Roots that are not the root of a subvolume
+// are scanned completely. Returns the subvolumes with the generation to record when the run has succeeded.
+func collectNewFiles(ctx context, roots []string, since int64, minSize int) []scannedSubvolume {
+	fmt.Printf("Searching for files with new extents\n")
+	var scanned []scannedSubvolume
+	found := &newFiles{paths: make(map[string]bool), csums: make(map[[storage.MaxHashSize]byte]bool)}
+	for _, name := range roots {
+		rootPath, err := filepath.Abs(name)
+		if err != nil || !isSubvolumeRoot(rootPath) {
+			log.Printf("%s is not the root of a subvolume, all files will be scanned", name)
+			collectFiles(ctx, -1, name, minSize)
+			continue
+		}
+		root, err := os.Open(rootPath)
+		if err != nil {
+			log.Printf("Error while opening %s: %v", rootPath, err)
+			continue
+		}
+		if fi, err := root.Stat(); err == nil {
+			ctx.fs.enterRoot(rootPath, fi)
+		}
+		subvolumes, err := subvolumesOf(root)
+		if err != nil {
+			log.Printf("Unable to list the subvolumes of %s, all files will be scanned: %v", rootPath, err)
+			collectFiles(ctx, -1, name, minSize)
+			root.Close()
+			continue
+		}
+		for _, subvolume := range subvolumes {
+			path := filepath.Join(rootPath, subvolume.Path)
+			generation, err := sys.SubvolumeGeneration(root, subvolume.ID)
+			if err != nil {
+				log.Printf("Unable to get the generation of subvolume %s: %v", path, err)
+				continue
+			}
+			from := uint64(0)
+			if since >= 0 {
+				from = uint64(since)
+			} else if recorded, ok := ctx.cache.Generation(path); ok {
+				from = recorded
+			}
+			if err := collectNewFilesInSubvolume(ctx, root, subvolume, path, from, found, minSize); err != nil {
+				log.Printf("Error while searching for new files in subvolume %s: %v", path, err)
+				continue
+			}
+			scanned = append(scanned, scannedSubvolume{path, generation})
+		}
+		root.Close()
+	}
+
+	// partners from the cache may be on any filesystem that has been scanned before
+	ctx.fs.leaveRoot()
+	newCount := len(found.paths)
+	for _, path := range ctx.cache.Partners(found.csums) {
+		found.add(ctx, path, minSize)
+	}
+	log.Printf("Found %d new files and %d cached files that may be duplicates", newCount, len(found.paths)-newCount)
+	return scanned
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Set when the run is interrupted by SIGINT or SIGTERM. The passes stop at the next file or deduplication request, so
+// the temporary files can be removed and the statistics can be reported. A second signal exits immediately.
+type interruption struct {
+	signal int32
+}
+
+// Starts handling SIGINT and SIGTERM
+func handleInterrupts() *interruption {
+	i := &interruption{}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, stopping after the current operation. Interrupt again to exit immediately", sig)
+		atomic.StoreInt32(&i.signal, int32(sig.(syscall.Signal)))
+		sig = <-signals
+		log.Printf("Received %v again, exiting immediately", sig)
+		os.Exit(exitCode(sig.(syscall.Signal)))
+	}()
+	return i
+}
+
+// Returns true if the run is interrupted, can be called on a nil interruption
+func (i *interruption) interrupted() bool {
+	return i != nil && atomic.LoadInt32(&i.signal) != 0
+}
+
+// Returns the exit code for the interrupted run, 0 if the run is not interrupted
+func (i *interruption) exitCode() int {
+	if !i.interrupted() {
+		return 0
+	}
+	return exitCode(syscall.Signal(atomic.LoadInt32(&i.signal)))
+}
+
+// The exit code of a process terminated by the signal, as reported by the shell
+func exitCode(sig syscall.Signal) int {
+	return 128 + int(sig)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestInterruptedDedupStopsBeforeNextRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, name := range []string{a, b} {
+		if err := ioutil.WriteFile(name, make([]byte, 8192), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	interrupt := &interruption{signal: int32(syscall.SIGINT)}
+	result := DedupRanges(a, []string{b}, [][]byteRange{{{0, 8192}}}, 4096, interrupt)
+	if result != (dedupResult{}) {
+		t.Errorf("Expected no deduplication requests, but was %+v", result)
+	}
+	if code := interrupt.exitCode(); code != 130 {
+		t.Errorf("Expected exit code 130, but was %d", code)
+	}
+	var none *interruption
+	if none.interrupted() || none.exitCode() != 0 {
+		t.Errorf("Expected a nil interruption to not be interrupted")
+	}
+}
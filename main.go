@@ -1,26 +1,19 @@
 package main
 
 import (
-	"crypto/md5"
 	"flag"
 	"fmt"
 	"github.com/bertbaron/btrdedup/storage"
 	"github.com/bertbaron/btrdedup/sys"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh/terminal"
-	"io/ioutil"
 	"log"
-	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime/pprof"
-	"strings"
+	"sync"
 	"syscall"
-)
-
-const (
-	blockSize int64 = 4096
+	"time"
 )
 
 var (
@@ -31,7 +24,44 @@ var (
 type context struct {
 	pathstore storage.PathStorage
 	stats     *storage.Statistics
+	// state and sector size of the filesystem that is being processed, see on
 	state     storage.DedupInterface
+	blockSize int64
+	// nil if no cache is used
+	cache     *storage.ScanCache
+	hash      *hashAlgorithm
+	fs        *filesystems
+	filter    *filter
+	links     *hardlinks
+	// nil unless the -noact option is given
+	estimates *savingsEstimates
+	// nil unless the -checkpoint option is given
+	checkpoint *checkpoint
+	interrupt  *interruption
+	// options for the defragmentation of files, the length is limited to the deduplicated range if defragRange is set
+	defrag      sys.DefragOptions
+	defragRange bool
+	// nil unless files are defragmented, with the minimal average number of blocks per fragment for the bpf policy
+	policy *defragPolicy
+	minBpf int
+	// nil unless files are defragmented
+	reserve *spaceReserve
+	// chooses the file towards which the others are deduplicated, nil for the file with the fewest fragments
+	source      *sourcePolicy
+	sourcePaths []condition
+	// ages of the subvolumes for the oldest source policy
+	subvolumes *subvolumeAges
+	// number of passes of the run, 2 in the defrag mode
+	passes    int
+	// number of concurrent jobs for scanning and hashing files
+	jobs      int
+}
+
+// Returns the context for processing the files of the given filesystem
+func (ctx context) on(fs *filesystem) context {
+	ctx.state = fs.state
+	ctx.blockSize = fs.sectorSize
+	return ctx
 }
 
 // readDirNames reads the directory named by dirname
@@ -61,39 +91,33 @@ func readFileMeta(pathnr int32, path string) (*storage.FileInformation, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to read fragments for file")
 	}
-
-	var tot uint64
 	for _, frag := range fragments {
-		tot += frag.Length
-	}
-	if uint64(size) > tot {
-		log.Printf("Skipping sparse file %s", path)
-		return nil, nil
+		if frag.Delalloc() {
+			log.Printf("Skipping %s, it has data that is not allocated on disk yet", path)
+			return nil, nil
+		}
 	}
 
 	return &storage.FileInformation{Path: pathnr, Size: size, Fragments: fragments}, nil
 }
 
-func makeChecksum(data []byte) [16]byte {
-	return md5.Sum(data)
-}
-
-func readChecksum(path string) (*[16]byte, error) {
+// Returns the checksum of the first block of the file
+func readChecksum(hash *hashAlgorithm, path string, blockSize int64) (*[storage.MaxHashSize]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "open file failed")
 	}
 	defer f.Close()
-	buffer := make([]byte, 4096)
+	buffer := make([]byte, blockSize)
 	n1, err := f.Read(buffer)
 	if err != nil {
 		return nil, errors.Wrap(err, "reading from file")
 	}
-	if n1 < 4096 {
+	if int64(n1) < blockSize {
 		// We assume that the full block is read at once. If proven false we need to read in a loop
-		return nil, errors.New("Less than 4k read, skipping block")
+		return nil, errors.Errorf("Less than %d bytes read, skipping block", blockSize)
 	}
-	csum := makeChecksum(buffer)
+	csum := hash.sum(buffer)
 	return &csum, nil
 }
 
@@ -101,32 +125,50 @@ func readChecksum(path string) (*[16]byte, error) {
 // PRE: all files start at the same offset and files is not empty
 func createChecksums(ctx context, files []*storage.FileInformation) bool {
 	defer ctx.stats.HashesCalculated(len(files))
+	if ctx.interrupt.interrupted() {
+		return false
+	}
+	if allCached(files) {
+		return true
+	}
 	pathnr := files[0].Path
 	path := ctx.pathstore.FilePath(pathnr)
-	csum, err := readChecksum(path)
+	csum, err := readChecksum(ctx.hash, path, ctx.blockSize)
 	if err != nil {
 		log.Printf("Error creating checksum for first block of file %s, %v", path, err)
 		for _, file := range files {
 			file.Error = true
+			ctx.stats.FileSkipped(storage.SkippedError)
 		}
 		return false
 	}
 	for _, file := range files {
 		file.Csum = *csum
+		if ctx.cache != nil {
+			ctx.cache.Update(file)
+		}
 	}
 	return true
 }
 
-func collectFiles(ctx context, parent int32, name string, minSize int, exclude string) {
+func allCached(files []*storage.FileInformation) bool {
+	for _, file := range files {
+		if !file.HasCsum {
+			return false
+		}
+	}
+	return true
+}
+
+func collectFiles(ctx context, parent int32, name string, minSize int) {
+	if ctx.interrupt.interrupted() {
+		return
+	}
 	path := name
 	if parent >= 0 {
 		path = filepath.Join(ctx.pathstore.DirPath(parent), name)
 	}
 
-	if exclude != "" && strings.HasPrefix(path, exclude) {
-		log.Printf("Excluding %s", path)
-		return
-	}
 	fi, err := os.Lstat(path)
 	if err != nil {
 		log.Printf("Error using os.Lstat on file %s: %v", path, err)
@@ -137,6 +179,26 @@ func collectFiles(ctx context, parent int32, name string, minSize int, exclude s
 		return
 	}
 
+	if parent < 0 {
+		ctx.fs.enterRoot(path, fi)
+	}
+	fs := ctx.fs.accept(path, fi)
+	if fs == nil {
+		if fi.Mode().IsRegular() {
+			ctx.stats.FileSkipped(filesystemSkipReason(ctx, path, fi))
+		}
+		return
+	}
+
+	if ctx.filter.excluded(path, fi) {
+		if fi.IsDir() {
+			log.Printf("Excluding %s", path)
+		} else {
+			ctx.stats.FileSkipped(storage.SkippedExcluded)
+		}
+		return
+	}
+
 	switch mode := fi.Mode(); {
 	case mode.IsDir():
 		elements, err := readDirNames(path)
@@ -146,41 +208,98 @@ func collectFiles(ctx context, parent int32, name string, minSize int, exclude s
 		}
 		pathnr := ctx.pathstore.AddDir(parent, name)
 		for _, e := range elements {
-			collectFiles(ctx, pathnr, e, minSize, exclude)
+			collectFiles(ctx, pathnr, e, minSize)
 		}
 	case mode.IsRegular():
 		size := fi.Size()
-		if size/blockSize >= int64(minSize) {
-			ctx.pathstore.AddFile(parent, name)
+		if size/fs.sectorSize < int64(minSize) {
+			ctx.stats.FileSkipped(storage.SkippedTooSmall)
+		} else if ctx.links.alias(path, fi) {
+			ctx.stats.FileSkipped(storage.SkippedHardLink)
+		} else {
+			filenr := ctx.pathstore.AddFile(parent, name)
+			ctx.links.register(filenr, fi)
+			ctx.fs.addFile(filenr, fs)
 		}
 	}
 }
 
-func loadFileInformation(ctx context) {
-	ctx.pathstore.ProcessFiles(func(filenr int32, path string) {
-		defer ctx.stats.FileInfoRead()
-		fileInformation, err := readFileMeta(filenr, path)
-		if err != nil {
-			log.Printf("Error while trying to get the fragments of file %s: %v", path, err)
-			return
-		}
-		if fileInformation != nil {
+// Returns the reason for which the filesystem of a file is not accepted
+func filesystemSkipReason(ctx context, path string, fi os.FileInfo) string {
+	if ctx.fs.of(path, fi) == nil {
+		return storage.SkippedError
+	}
+	return storage.SkippedOtherFilesystem
+}
+
+func loadFile(ctx context, filenr int32, path string) {
+	defer ctx.stats.FileInfoRead()
+	if ctx.interrupt.interrupted() {
+		return
+	}
+	state := ctx.fs.ofFile(filenr).state
+	if ctx.cache != nil {
+		if fileInformation, ok := ctx.cache.Lookup(filenr, path); ok {
 			ctx.stats.FileAdded()
-			ctx.state.AddFile(*fileInformation)
+			state.AddFile(*fileInformation)
+			return
 		}
+	}
+	fileInformation, err := readFileMeta(filenr, path)
+	if err != nil {
+		log.Printf("Error while trying to get the fragments of file %s: %v", path, err)
+		ctx.stats.FileSkipped(storage.SkippedError)
+		return
+	}
+	if fileInformation == nil {
+		ctx.stats.FileSkipped(storage.SkippedUnallocated)
+		return
+	}
+	ctx.stats.FileAdded()
+	state.AddFile(*fileInformation)
+}
+
+type fileRef struct {
+	filenr int32
+	path   string
+}
+
+// Reads the file information of all files using the configured number of concurrent jobs
+func loadFileInformation(ctx context) {
+	files := make(chan fileRef, ctx.jobs*2)
+	var wg sync.WaitGroup
+	for i := 0; i < ctx.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				loadFile(ctx, file.filenr, file.path)
+			}
+		}()
+	}
+	ctx.pathstore.ProcessFiles(func(filenr int32, path string) {
+		files <- fileRef{filenr, path}
 	})
+	close(files)
+	wg.Wait()
 }
 
-func allowedFragcount(file *storage.FileInformation, minBpf int) int {
-	fragSize := int64(minBpf) * blockSize
-	return int((file.Size - 1) / fragSize) +1
+// Defragments the file with the given options
+func defragFile(path string, options sys.DefragOptions) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sys.DefragRange(file, options)
 }
-// Currently we always deduplicate towards the first file. Therefore we place the least-defragmented file in first
-// position and, if the fragmentation is higher than the threshold, defragment it first.
+
+// Currently we always deduplicate towards the first file. Therefore we place the file chosen by the source policy in
+// first position and, if the fragmentation is higher than the threshold, defragment it first.
 //
 // Note that when we will do the deduplication more clever (comparing all blocks of all files), we may also need to do
 // the defragmentation in a more clever way.
-func reorderAndDefragIfNeeded(ctx context, files []*storage.FileInformation, minBpf int, noact bool) (copy []*storage.FileInformation) {
+func reorderAndDefragIfNeeded(ctx context, files []*storage.FileInformation, noact bool) (copy []*storage.FileInformation) {
 	if len(files) == 0 {
 		return files
 	}
@@ -189,127 +308,258 @@ func reorderAndDefragIfNeeded(ctx context, files []*storage.FileInformation, min
 		copy[idx] = file
 	}
 
-	// least-fragmented file first
-	for idx, file := range copy {
-		if len(file.Fragments) < len(copy[0].Fragments) {
-			copy[0], copy[idx] = copy[idx], copy[0]
-		}
-	}
+	source := ctx.chooseSource(copy)
+	copy[0], copy[source] = copy[source], copy[0]
 
-	if minBpf < 1 {
-		return
-	}
 	fragcount := len(copy[0].Fragments)
-	allowedFragcount := allowedFragcount(copy[0], minBpf)
-	allowedFragcount = 1
-	if fragcount <= allowedFragcount {
+	decision := ctx.defragDecision(copy[0])
+	if !decision.defrag {
+		ctx.reportExemption(copy[0], decision)
 		return
 	}
 
-	// Non-writable files (i.e. from read-only snapshots) can not be defragmented, so find a writable file
-	writableFound := false
+	// Non-writable files (i.e. from read-only snapshots) can not be defragmented, so find a writable file. It only
+	// replaces the source when it is actually defragmented, otherwise the source chosen by the policy is kept.
+	writable := -1
 	for idx, file := range copy {
 		if file.Writable(ctx.pathstore) {
-			copy[0], copy[idx] = copy[idx], copy[0]
-			writableFound = true
-			break;
+			writable = idx
+			break
 		}
 	}
 
-	file := copy[0]
-	path := ctx.pathstore.FilePath(file.Path)
-
-	if !writableFound {
+	if writable < 0 {
+		path := ctx.pathstore.FilePath(copy[0].Path)
 		log.Printf("File %s can not be defragmented, none of the duplicates are writable", path)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragNotWritable, Reason: decision.reason})
 		return
 	}
 
+	file := copy[writable]
+	path := ctx.pathstore.FilePath(file.Path)
+
+	// the writable file may be more fragmented than the source and may have other attributes
+	if writable != 0 {
+		if decision = ctx.defragDecision(file); !decision.defrag {
+			ctx.reportExemption(file, decision)
+			return
+		}
+	}
 	fragcount = len(file.Fragments)
 
 	if noact {
-		log.Printf("File %s has %d fragments while we want max %d, but will not be defragmented because -noact option is specified", path, fragcount, allowedFragcount)
+		log.Printf("File %s has %s, but will not be defragmented because -noact option is specified", path, decision.reason)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragNoact, Reason: decision.reason})
 		return
 	}
 
-	log.Printf("File %s has %d fragments while we want max %d, starting defragmentation", path, fragcount, allowedFragcount)
-	command := exec.Command("btrfs", "filesystem", "defragment", "-f", path)
-	stderr, err := command.StderrPipe()
-	if err != nil {
-		log.Fatal(err)
+	options := ctx.defrag
+	if ctx.defragRange {
+		options.Length = uint64(dedupSize(copy, ctx.blockSize))
+	}
+	needed := file.Size
+	if options.Length != 0 {
+		needed = int64(options.Length)
 	}
-	if err := command.Start(); err != nil {
-		log.Printf("Defragmentation of %s failed to start: %v", path, err)
+	if shortage := ctx.reserve.check(path, needed); shortage != "" {
+		ctx.reportShortage(path, fragcount, decision, shortage)
 		return
 	}
 
-	errorOutput, _ := ioutil.ReadAll(stderr)
-	if err := command.Wait(); err != nil {
+	log.Printf("File %s has %s, starting defragmentation", path, decision.reason)
+	if ctx.cache != nil {
+		ctx.cache.Invalidate(file.Path)
+	}
+	if err := defragFile(path, options); err != nil {
 		log.Printf("Defragmentation of %s failed: %v", path, err)
-		log.Printf("Defragmentation error output: %s", errorOutput)
+		ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragFailed, Reason: decision.reason, Error: err.Error()})
 		return
 	}
 
+	action := storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragDone, Reason: decision.reason}
+	defer func() { ctx.stats.Defragmented(action) }()
+	if writable != 0 {
+		action.Overrides = ctx.pathstore.FilePath(copy[0].Path)
+		log.Printf("Deduplicating towards the defragmented file %s instead of %s, which was chosen as source but is not writable", path, action.Overrides)
+		copy[0], copy[writable] = copy[writable], copy[0]
+	}
 	if newFile, err := readFileMeta(file.Path, path); err != nil {
 		log.Printf("Error while reading the fragmentation table again: %v", err)
-		return reorderAndDefragIfNeeded(ctx, copy[1:], minBpf, noact)
+		return reorderAndDefragIfNeeded(ctx, copy[1:], noact)
 	} else if newFile == nil {
 		log.Printf("File can not be deduplicated after defragmentation")
-		return reorderAndDefragIfNeeded(ctx, copy[1:], minBpf, noact)
+		return reorderAndDefragIfNeeded(ctx, copy[1:], noact)
 	} else {
+		newFile.Csum = file.Csum
+		newFile.EqualSize = file.EqualSize
 		copy[0] = newFile
+		action.FragmentsAfter = len(newFile.Fragments)
 		log.Printf("Number of fragments was %d and is now %d for file %s", fragcount, len(newFile.Fragments), path)
 	}
 	return
 }
 
-// Returns the first offset that is not shared amongst the files, or size if the files are
-// shared up to the specified size
-func unsharedStart(files []*storage.FileInformation, size int64) int64 {
-	for i := int64(0); i < size; i+=blockSize {
-		offset := files[0].PhysicalOffsetAt(i)
-		for _, file := range files[1:] {
-			if file.PhysicalOffsetAt(i) != offset {
-				return i
+// Returns the maximal ranges up to the specified size for which dest is not known to share its data with source.
+// Holes and inline data in either file are not included, because they can not be deduplicated. The ranges are in
+// logical order.
+func unsharedRanges(source, dest *storage.FileInformation, size int64) []byteRange {
+	return rangesWhere(source, dest, size, func(sExtent, dExtent storage.Extent) bool {
+		return !sExtent.SameData(dExtent)
+	})
+}
+
+// Returns the ranges up to the specified size for which the deduplicable extents of both files match the predicate,
+// merged and in logical order
+func rangesWhere(source, dest *storage.FileInformation, size int64, predicate func(sExtent, dExtent storage.Extent) bool) []byteRange {
+	var ranges []byteRange
+	forEachExtentPair(source, dest, size, func(offset, length int64, sExtent, dExtent storage.Extent) {
+		if !deduplicable(sExtent) || !deduplicable(dExtent) || !predicate(sExtent, dExtent) {
+			return
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].offset+ranges[last].length == offset {
+			ranges[last].length += length
+		} else {
+			ranges = append(ranges, byteRange{offset, length})
+		}
+	})
+	return ranges
+}
+
+// Returns the number of bytes up to the specified size for which dest already shares its data with source
+func alreadyShared(source, dest *storage.FileInformation, size int64) int64 {
+	var shared int64
+	forEachExtentPair(source, dest, size, func(offset, length int64, sExtent, dExtent storage.Extent) {
+		if deduplicable(sExtent) && deduplicable(dExtent) && sExtent.SameData(dExtent) {
+			shared += length
+		}
+	})
+	return shared
+}
+
+// Calls f for each range up to the specified size in which both files have a single extent, in logical order
+func forEachExtentPair(source, dest *storage.FileInformation, size int64, f func(offset, length int64, sExtent, dExtent storage.Extent)) {
+	sourceCursor, destCursor := storage.NewExtentCursor(source), storage.NewExtentCursor(dest)
+	var offset int64
+	for offset < size {
+		sExtent := sourceCursor.At(offset)
+		dExtent := destCursor.At(offset)
+		length := sExtent.Length
+		if dExtent.Length < length {
+			length = dExtent.Length
+		}
+		if remaining := uint64(size - offset); remaining < length {
+			length = remaining
+		}
+		if length == 0 {
+			break
+		}
+		f(offset, int64(length), sExtent, dExtent)
+		offset += int64(length)
+	}
+}
+
+func deduplicable(extent storage.Extent) bool {
+	return !extent.Hole && !extent.Fragment.Inline()
+}
+
+// Returns the number of bytes in the ranges that are stored in encoded (compressed) extents in the file
+func encodedLength(file *storage.FileInformation, ranges []byteRange) int64 {
+	var encoded int64
+	cursor := storage.NewExtentCursor(file)
+	for _, r := range ranges {
+		for offset := r.offset; offset < r.offset+r.length; {
+			extent := cursor.At(offset)
+			length := int64(extent.Length)
+			if remaining := r.offset + r.length - offset; length == 0 || remaining < length {
+				length = remaining
 			}
+			if extent.Fragment.Encoded() {
+				encoded += length
+			}
+			offset += length
+		}
+	}
+	return encoded
+}
+
+// Returns the size up to which the files can be deduplicated. The files have been verified to be equal up to
+// EqualSize, which is rounded down to the block size unless it is the end of all files.
+func dedupSize(files []*storage.FileInformation, blockSize int64) int64 {
+	size := files[0].EqualSize
+	for _, file := range files {
+		if file.Size != size {
+			return size - size%blockSize
 		}
 	}
 	return size
 }
 
+// Returns a description of the number of other names the files have through hard links, for logging
+func aliasInfo(ctx context, files []*storage.FileInformation) string {
+	aliases := 0
+	for _, file := range files {
+		aliases += len(ctx.links.aliasesOf(file.Path))
+	}
+	if aliases == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (with %d hard links)", aliases)
+}
+
 // Submits the files for deduplication. Only if duplication seems to make sense they will actually be deduplicated
-func submitForDedup(ctx context, files []*storage.FileInformation, minBpf int, noact bool) {
+func submitForDedup(ctx context, files []*storage.FileInformation, noact bool) {
 	defer ctx.stats.Deduplicating(len(files))
+	if ctx.interrupt.interrupted() {
+		return
+	}
 
-	files = reorderAndDefragIfNeeded(ctx, files, minBpf, noact)
+	files = reorderAndDefragIfNeeded(ctx, files, noact)
 
 	if len(files) < 2 || files[0].Error {
 		return
 	}
 
-	// currently we assume that the files are equal up to the size of the smallest file
-	var size int64 = math.MaxInt64
-	for _, file := range files {
-		if file.Size < size {
-			size = file.Size
-		}
+	size := dedupSize(files, ctx.blockSize)
+	if size == 0 {
+		return
 	}
 
 	filenames := make([]string, len(files))
 	for i, file := range files {
 		filenames[i] = ctx.pathstore.FilePath(file.Path)
 	}
-	startUnshared := unsharedStart(files, size)
-	if startUnshared == size {
+	ranges := make([][]byteRange, len(files)-1)
+	var unshared, encoded, shared int64
+	for i, file := range files[1:] {
+		ranges[i] = unsharedRanges(files[0], file, size)
+		shared += alreadyShared(files[0], file, size)
+		for _, r := range ranges[i] {
+			unshared += r.length
+		}
+		// compressed extents are always offered, because it is unknown whether they are shared already
+		encoded += encodedLength(file, ranges[i])
+	}
+	ctx.stats.Candidate(len(files), shared)
+	if unshared == 0 {
 		//log.Printf("Skipping %s and %d other files, they are already shared", filenames[0], len(files)-1)
 		return
 	}
 	if !noact {
-		log.Printf("Offering for deduplication: %s and %d other files from offset %d\n", filenames[0], len(files)-1, startUnshared)
-		offset:=uint64(startUnshared)
-		length:=uint64(size-startUnshared)
-		Dedup(filenames, offset, length)
+		log.Printf("Offering for deduplication: %s and %d other files%s, %d unshared bytes of which %d compressed\n", filenames[0], len(files)-1, aliasInfo(ctx, files), unshared, encoded)
+		if ctx.cache != nil {
+			for i, file := range files[1:] {
+				if len(ranges[i]) > 0 {
+					ctx.cache.Invalidate(file.Path)
+				}
+			}
+		}
+		ctx.stats.Offered(unshared, encoded)
+		result := DedupRanges(filenames[0], filenames[1:], ranges, uint64(ctx.blockSize), ctx.interrupt)
+		ctx.stats.Deduplicated(int64(result.bytesDeduped), result.dataDiffers, result.errors)
 	} else {
-		log.Printf("Candidate for deduplication: %s and %d other files\n", filenames[0], len(files)-1)
+		log.Printf("Candidate for deduplication: %s and %d other files%s, %d unshared bytes of which %d compressed\n", filenames[0], len(files)-1, aliasInfo(ctx, files), unshared, encoded)
+		savings, compressed := distinctBytes(files[1:], ranges)
+		ctx.estimates.add(savingsEstimate{path: filenames[0], files: len(files), bytes: savings, compressed: compressed})
 	}
 }
 
@@ -318,7 +568,7 @@ func updateOpenFileLimit() {
 	var rLimit syscall.Rlimit
 	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 	if err != nil {
-		log.Printf("Error Getting Rlimit ", err)
+		log.Printf("Error Getting Rlimit: %v", err)
 	}
 	log.Printf("Current open file limit: %v", rLimit.Cur)
 	if rLimit.Cur < rLimit.Max {
@@ -335,42 +585,105 @@ func updateOpenFileLimit() {
 	}
 }
 
-func collectApplicableFiles(ctx context, filenames []string, minSize int, exclude string) {
+func collectApplicableFiles(ctx context, filenames []string, minSize int) {
 	fmt.Printf("Searching for applicable files\n")
 	for _, filename := range filenames {
-		collectFiles(ctx, -1, filename, minSize, exclude)
+		collectFiles(ctx, -1, filename, minSize)
 	}
 }
 
 func pass1(ctx context) {
-	fmt.Printf("Pass 1 of 3, collecting fragmentation information\n")
-	ctx.state.StartPass1()
+	fmt.Printf("Pass 1 of %d, collecting fragmentation information\n", ctx.passes)
+	for _, fs := range ctx.fs.list {
+		fs.state.StartPass1()
+	}
 	ctx.stats.StartFileinfoProgress()
 	loadFileInformation(ctx)
 	ctx.stats.StopProgress()
-	ctx.state.EndPass1()
+	if ctx.interrupt.interrupted() {
+		return
+	}
+	for _, fs := range ctx.fs.list {
+		fs.state.EndPass1()
+	}
+	ctx.checkpoint.passCompleted(ctx, 1)
 }
 
+// Each filesystem is processed independently in the other passes
+
 func pass2(ctx context) {
-	fmt.Printf("Pass 2 of 3, calculating hashes for first block of files\n")
-	ctx.state.StartPass2()
+	fmt.Printf("Pass 2 of 4, calculating hashes for first block of files\n")
 	ctx.stats.StartHashProgress()
-	ctx.state.PartitionOnOffset(func(files []*storage.FileInformation) bool {
-		return createChecksums(ctx, files)
-	})
+	for _, fs := range ctx.fs.list {
+		if ctx.checkpoint.skip(fs, 2) {
+			continue
+		}
+		ctx := ctx.on(fs)
+		ctx.state.StartPass2()
+		ctx.state.PartitionOnOffset(ctx.jobs, func(files []*storage.FileInformation) bool {
+			return createChecksums(ctx, files)
+		})
+		if ctx.interrupt.interrupted() {
+			break
+		}
+		ctx.state.EndPass2()
+		ctx.checkpoint.filesystemCompleted(fs, 2)
+	}
 	ctx.stats.StopProgress()
-	ctx.state.EndPass2()
+	if ctx.interrupt.interrupted() {
+		return
+	}
+	ctx.checkpoint.passCompleted(ctx, 2)
 }
 
-func pass3(ctx context, minBpf int, noact bool) {
-	fmt.Printf("Pass 3 of 3, deduplucating files\n")
-	ctx.state.StartPass3()
+func pass3(ctx context) {
+	fmt.Printf("Pass 3 of 4, verifying the content of files with equal first block\n")
+	ctx.stats.StartVerifyProgress()
+	for _, fs := range ctx.fs.list {
+		if ctx.checkpoint.skip(fs, 3) {
+			continue
+		}
+		ctx := ctx.on(fs)
+		ctx.state.StartPass3()
+		ctx.state.PartitionOnHash(ctx.checkpoint.verifyReceiver(ctx, fs, func(files []*storage.FileInformation) [][]*storage.FileInformation {
+			return verifyContent(ctx, files)
+		}))
+		if ctx.interrupt.interrupted() {
+			break
+		}
+		ctx.state.EndPass3()
+		ctx.checkpoint.filesystemCompleted(fs, 3)
+	}
+	ctx.stats.StopProgress()
+	if ctx.interrupt.interrupted() {
+		return
+	}
+	ctx.checkpoint.passCompleted(ctx, 3)
+}
+
+func pass4(ctx context, noact bool) {
+	fmt.Printf("Pass 4 of 4, deduplicating files\n")
 	ctx.stats.StartDedupProgress()
-	ctx.state.PartitionOnHash(func(files []*storage.FileInformation) {
-		submitForDedup(ctx, files, minBpf, noact)
-	})
+	for _, fs := range ctx.fs.list {
+		if ctx.checkpoint.skip(fs, 4) {
+			continue
+		}
+		ctx := ctx.on(fs)
+		ctx.state.StartPass4()
+		ctx.state.PartitionOnContent(ctx.checkpoint.dedupReceiver(ctx, fs, func(files []*storage.FileInformation) {
+			submitForDedup(ctx, files, noact)
+		}))
+		if ctx.interrupt.interrupted() {
+			break
+		}
+		ctx.state.EndPass4()
+		ctx.checkpoint.filesystemCompleted(fs, 4)
+	}
 	ctx.stats.StopProgress()
-	ctx.state.EndPass3()
+	if ctx.interrupt.interrupted() {
+		return
+	}
+	ctx.checkpoint.passCompleted(ctx, 4)
 }
 
 func writeHeapProfile(basename string, suffix string) {
@@ -387,24 +700,55 @@ func writeHeapProfile(basename string, suffix string) {
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... [FILE-OR-DIR]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "   or: %s defrag [OPTION]... [FILE-OR-DIR]...\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	// in the defrag mode all fragmented files are defragmented and their copies are relinked, see defragPass
+	defragMode := len(os.Args) > 1 && os.Args[1] == "defrag"
 	showVersion := flag.Bool("version", false, "show version information and exits")
 	noact := flag.Bool("noact", false, "if provided, the tool will only scan and log results, but not actually deduplicate")
-	lowmem := flag.Bool("lowmem", false, "if provided, the tool will use much less memory by using temporary files and the external sort command")
+	lowmem := flag.Bool("lowmem", false, "if provided, the tool will use much less memory by keeping the state in temporary files, which are sorted in chunks that fit in -sortmem")
+	sortMemory := flag.Int64("sortmem", storage.DefaultSortMemory/(1024*1024), "memory budget in MB for sorting the temporary files in low memory mode")
+	tempDir := flag.String("tmpdir", "", "directory for the temporary files in low memory mode, default is the system temporary directory")
 	nopb := flag.Bool("nopb", false, "if provided, the tool will not show the progress bar even if a terminal is detected")
-	exclude := flag.String("exclude", "", "Path prefix to exclude (i.e. exclude=/var/lib/docker)")
+	var ruleArgs []ruleArg
+	flag.Var(ruleOption{"exclude", &ruleArgs}, "exclude", "exclude files and directories matching the rule (i.e. -exclude /var/lib/docker or -exclude 'ext:iso size:<1M'), may be repeated")
+	flag.Var(ruleOption{"include", &ruleArgs}, "include", "include files and directories matching the rule even if they match an earlier exclude rule, may be repeated")
+	flag.Var(ruleOption{"rules", &ruleArgs}, "rules", "read include and exclude rules from the given file, may be repeated")
+	xdev := flag.Bool("xdev", false, "don't descend into directories on other filesystems than the given paths")
+	ignoreFiles := flag.Bool("ignorefiles", false, "read additional rules from the "+ignoreFileName+" file in each directory")
 	defrag := flag.Bool("defrag", false, "defragment files with less than the configured number of blocks per fragment")
-	minBpf := flag.Int("bpf", 1024, "minimal average number of blocks per fragment before defragmentation, default=1024 (4MB)")
-	minSize := flag.Int("minsize", 1, "skip files with size less than the given number of blocks, default is 1")
+	minBpf := flag.Int("bpf", 1024, "minimal average number of blocks per fragment before defragmentation, default=1024 (4MB with 4k sectors)")
+	sourceName := flag.String("source", "fragments", "policy that chooses the file towards which the other files are deduplicated, one of: "+sourcePolicyNames())
+	var sourcePaths []condition
+	flag.Var(sourcePathOption{&sourcePaths}, "sourcepath", "with -source path, prefer files matching this pattern (i.e. /data/live/**) as source, may be repeated in order of preference")
+	defragPolicyName := flag.String("defragpolicy", "bpf", "policy that decides which files are defragmented, one of: "+defragPolicyNames())
+	defragThreshold := flag.Int("defragthreshold", 0, "with -defrag, only rewrite extents smaller than this number of KB, default is the kernel default (32MB)")
+	defragCompress := flag.String("defragcompress", "none", "with -defrag, recompress the defragmented data with this algorithm, one of: none, zlib, lzo, zstd")
+	defragReserve := flag.String("defragreserve", "1G", "with -defrag, keep at least this much free space (i.e. 10G) on the filesystem. When space is short, the filesystem is synced a few times with increasing pauses, after which files of which the defragmentation would still use the reserve are skipped")
+	defragRange := flag.Bool("defragrange", false, "with -defrag, only defragment the part of the file that is going to be deduplicated")
+	minSize := flag.Int("minsize", 1, "skip files with size less than the given number of blocks (sectors of the filesystem), default is 1")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile := flag.String("memprofile", "", "write memory profile to this file")
-	flag.Parse()
-
-	if !*defrag {
-		*minBpf = 0
+	cacheFile := flag.String("cache", "", "keep the scan results in this file to skip unchanged files in subsequent runs")
+	cacheMaxAge := flag.Duration("cachemaxage", 0, "rescan files of which the cached scan results are older than this duration (i.e. 720h), default is to never rescan unchanged files")
+	hashName := flag.String("hash", "xxh3", "hash algorithm used to compare the content of files, one of: "+hashAlgorithmNames())
+	jobs := flag.Int("jobs", 1, "number of files to scan and hash concurrently, higher values may speed up scanning on SSDs")
+	incremental := flag.Bool("incremental", false, "only scan files with extents that are new since the last incremental run on the given subvolumes, and the cached files that may be duplicates of them. Requires -cache")
+	reportFile := flag.String("report", "", "write a summary of the run as JSON to this file")
+	metricsFile := flag.String("metrics", "", "write metrics in the Prometheus text format to this file, for the textfile collector of node_exporter")
+	metricsInterval := flag.Duration("metricsinterval", 30*time.Second, "interval at which the metrics file is updated during the run")
+	checkpointDir := flag.String("checkpoint", "", "save the progress of the run in this directory, so it can be resumed with -resume when it is interrupted")
+	checkpointInterval := flag.Duration("checkpointinterval", 10*time.Minute, "interval at which the progress within pass 3 and 4 is saved")
+	resume := flag.Bool("resume", false, "resume the run from the checkpoint given with -checkpoint")
+	since := flag.Int64("since", -1, "with -incremental, scan files with extents that are new since the given transaction id instead of since the last run")
+	if defragMode {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
 	}
 
+
 	if *showVersion {
 		fmt.Printf("btrdedup version '%s' built at '%s'\n", version, buildTime)
 		return
@@ -420,14 +764,69 @@ func main() {
 	}
 
 	var ctx context
+	ctx.passes = 4
+	if defragMode {
+		ctx.passes = 2
+		if *incremental || *checkpointDir != "" {
+			log.Fatal("The -incremental and -checkpoint options are not supported in the defrag mode")
+		}
+	}
 
+	hash, err := hashAlgorithmByName(*hashName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.hash = hash
+	ctx.links = newHardlinks()
+	ctx.filter, err = createFilter(ruleArgs, *ignoreFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.source, err = sourcePolicyByName(*sourceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.sourcePaths = sourcePaths
+	ctx.subvolumes = newSubvolumeAges()
+	if ctx.source.name == "path" && len(sourcePaths) == 0 {
+		log.Fatal("The path source policy requires the -sourcepath option")
+	}
+	ctx.jobs = *jobs
+	if ctx.jobs < 1 {
+		ctx.jobs = 1
+	}
+	if *defrag || defragMode {
+		if *minBpf < 1 {
+			log.Fatal("The -bpf option must be at least 1")
+		}
+		ctx.policy, err = defragPolicyByName(*defragPolicyName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx.minBpf = *minBpf
+		reserve, err := parseSize(*defragReserve)
+		if err != nil {
+			log.Fatalf("Invalid -defragreserve: %v", err)
+		}
+		ctx.reserve = &spaceReserve{reserve}
+	}
+	ctx.defrag.ExtentThreshold = uint32(*defragThreshold) * 1024
+	ctx.defrag.Compression, err = sys.ParseCompression(*defragCompress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.defragRange = *defragRange
 	ctx.pathstore = storage.NewPathStorage()
+	if *noact && !defragMode {
+		ctx.estimates = &savingsEstimates{}
+	}
 
 	ctx.stats = storage.NewProgressLogStats()
 	if !*nopb && terminal.IsTerminal(int(os.Stdout.Fd())) {
 		ctx.stats = storage.NewProgressBarStats()
 	}
 	ctx.stats.Start()
+	ctx.interrupt = handleInterrupts()
 
 	filenames := flag.Args()
 
@@ -436,29 +835,141 @@ func main() {
 		return
 	}
 
+	var metrics *storage.MetricsExporter
+	if *metricsFile != "" {
+		metrics = storage.NewMetricsExporter(*metricsFile, ctx.stats, *metricsInterval)
+	}
+
 	updateOpenFileLimit()
 
-	ctx.state = storage.NewMemoryBased()
+	newState := func() storage.DedupInterface {
+		return storage.NewMemoryBased()
+	}
 	if *lowmem {
 		log.Printf("Running in low memory mode")
-		ctx.state = storage.NewFileBased()
+		options := storage.SortOptions{Memory: *sortMemory * 1024 * 1024, TempDir: *tempDir, Jobs: ctx.jobs}
+		newState = func() storage.DedupInterface {
+			return storage.NewFileBased(ctx.hash.size, options)
+		}
 	}
+	ctx.fs = newFilesystems(*xdev, newState)
 
-	collectApplicableFiles(ctx, filenames, *minSize, *exclude)
+	if *cacheFile != "" {
+		cache, err := storage.LoadScanCache(*cacheFile, *cacheMaxAge, ctx.hash.name)
+		if err != nil {
+			log.Fatalf("Unable to load cache: %v", err)
+		}
+		ctx.cache = cache
+	}
+
+	if *incremental && ctx.cache == nil {
+		log.Fatal("The -incremental option requires the -cache option")
+	}
+	if *resume && *checkpointDir == "" {
+		log.Fatal("The -resume option requires the -checkpoint option")
+	}
+
+	var subvolumes []scannedSubvolume
+	if *resume {
+		ctx.checkpoint, err = loadCheckpoint(*checkpointDir, *checkpointInterval, filenames, ctx.hash.name, *lowmem)
+		if err == nil {
+			subvolumes, err = ctx.checkpoint.restore(&ctx)
+		}
+		if err != nil {
+			log.Fatalf("Unable to resume from checkpoint: %v", err)
+		}
+	} else {
+		if *incremental {
+			subvolumes = collectNewFiles(ctx, filenames, *since, *minSize)
+		} else {
+			collectApplicableFiles(ctx, filenames, *minSize)
+		}
+		if *checkpointDir != "" && !ctx.interrupt.interrupted() {
+			ctx.checkpoint, err = newCheckpoint(*checkpointDir, *checkpointInterval, filenames, ctx.hash.name, *lowmem)
+			if err != nil {
+				log.Fatalf("Unable to create checkpoint: %v", err)
+			}
+			ctx.checkpoint.filesCollected(ctx, subvolumes)
+		}
+	}
+	ctx.links.logSummary()
 	ctx.stats.SetFileCount(ctx.pathstore.FileCount())
+	ctx.reserve.preflight(filenames)
 
-	pass1(ctx)
+	if !ctx.checkpoint.completed(1) && !ctx.interrupt.interrupted() {
+		pass1(ctx)
+	}
 
 	writeHeapProfile(*memprofile, "_pass1")
 
-	pass2(ctx)
+	if defragMode {
+		if !ctx.interrupt.interrupted() {
+			defragPass(ctx, *noact)
+		}
+		writeHeapProfile(*memprofile, "_defrag")
+	} else {
+		if !ctx.checkpoint.completed(2) && !ctx.interrupt.interrupted() {
+			pass2(ctx)
+		}
+
+		writeHeapProfile(*memprofile, "_pass2")
+
+		if !ctx.checkpoint.completed(3) && !ctx.interrupt.interrupted() {
+			pass3(ctx)
+		}
+
+		writeHeapProfile(*memprofile, "_pass3")
+
+		if !ctx.interrupt.interrupted() {
+			pass4(ctx, *noact)
+		}
+
+		writeHeapProfile(*memprofile, "_pass4")
+	}
 
-	writeHeapProfile(*memprofile, "_pass2")
+	interrupted := ctx.interrupt.interrupted()
+	if interrupted {
+		ctx.checkpoint.saveProgress()
+	}
+	for _, fs := range ctx.fs.list {
+		fs.state.Close()
+	}
 
-	pass3(ctx, *minBpf, *noact)
+	if ctx.estimates != nil {
+		ctx.estimates.print(os.Stdout)
+	}
 
-	writeHeapProfile(*memprofile, "_pass3")
+	if ctx.cache != nil {
+		if !*noact && !interrupted {
+			for _, subvolume := range subvolumes {
+				ctx.cache.SetGeneration(subvolume.path, subvolume.generation)
+			}
+		}
+		// a resumed or interrupted run may not have seen all files
+		if err := ctx.cache.Save(!*incremental && !*resume && !interrupted); err != nil {
+			log.Printf("Unable to save cache: %v", err)
+		}
+	}
+
+	report := ctx.stats.Report()
+	report.Version = version
+	report.Noact = *noact
+	report.Interrupted = interrupted
+	if *reportFile != "" {
+		if err := report.Write(*reportFile); err != nil {
+			log.Printf("Unable to write report: %v", err)
+		}
+	}
+	report.Print(os.Stdout)
 
+	if metrics != nil {
+		metrics.Stop(!interrupted)
+	}
 	ctx.stats.Stop()
+	if interrupted {
+		fmt.Println("Interrupted")
+		pprof.StopCPUProfile()
+		os.Exit(ctx.interrupt.exitCode())
+	}
 	fmt.Println("Done")
 }
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -46,3 +52,146 @@ func TestSubmitForDefrag(t *testing.T) {
 
 	assertDefragResult(3, f1, f2)
 }
+
+// creates file information with fragments given as pairs of physical start and length
+func fileWithFragments(size int64, frags ...uint64) *storage.FileInformation {
+	file := &storage.FileInformation{Size: size}
+	var logical uint64
+	for i := 0; i < len(frags); i += 2 {
+		file.Fragments = append(file.Fragments, sys.Fragment{Logical: logical, Start: frags[i], Length: frags[i+1]})
+		logical += frags[i+1]
+	}
+	return file
+}
+
+func TestUnsharedRanges(t *testing.T) {
+	source := fileWithFragments(40, 100, 40)
+	dest := fileWithFragments(40, 100, 10, 500, 10, 120, 20)
+
+	ranges := unsharedRanges(source, dest, 40)
+	expected := []byteRange{{10, 10}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, but was %v", expected, ranges)
+	}
+}
+
+func TestUnsharedRangesMerged(t *testing.T) {
+	source := fileWithFragments(40, 100, 10, 200, 30)
+	dest := fileWithFragments(40, 100, 5, 300, 10, 400, 25)
+
+	ranges := unsharedRanges(source, dest, 40)
+	expected := []byteRange{{5, 35}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, but was %v", expected, ranges)
+	}
+}
+
+func TestUnsharedRangesLimitedBySize(t *testing.T) {
+	source := fileWithFragments(40, 100, 40)
+	dest := fileWithFragments(40, 100, 20, 300, 20)
+
+	if ranges := unsharedRanges(source, dest, 20); len(ranges) != 0 {
+		t.Errorf("Expected no unshared ranges, but was %v", ranges)
+	}
+}
+
+func TestAlreadyShared(t *testing.T) {
+	source := fileWithFragments(40, 100, 40)
+	dest := fileWithFragments(40, 100, 10, 500, 10, 120, 20)
+
+	if shared := alreadyShared(source, dest, 40); shared != 30 {
+		t.Errorf("Expected 30 shared bytes, but was %d", shared)
+	}
+}
+
+func TestUnsharedRangesSkipsHoles(t *testing.T) {
+	source := fileWithFragments(40, 100, 40)
+	// dest has a hole from 10 to 30
+	dest := &storage.FileInformation{Size: 40, Fragments: []sys.Fragment{
+		{Logical: 0, Start: 300, Length: 10},
+		{Logical: 30, Start: 400, Length: 10},
+	}}
+
+	ranges := unsharedRanges(source, dest, 40)
+	expected := []byteRange{{0, 10}, {30, 10}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, but was %v", expected, ranges)
+	}
+}
+
+func TestUnsharedRangesWithExtentFlags(t *testing.T) {
+	source := &storage.FileInformation{Size: 30, Fragments: []sys.Fragment{
+		{Logical: 0, Start: 100, Length: 10, Flags: sys.FIEMAP_EXTENT_ENCODED},
+		{Logical: 10, Start: 0, Length: 20, Flags: sys.FIEMAP_EXTENT_DATA_INLINE},
+	}}
+	dest := &storage.FileInformation{Size: 30, Fragments: []sys.Fragment{
+		{Logical: 0, Start: 100, Length: 10, Flags: sys.FIEMAP_EXTENT_ENCODED},
+		{Logical: 10, Start: 0, Length: 20, Flags: sys.FIEMAP_EXTENT_DATA_INLINE},
+	}}
+
+	// encoded extents are offered even at the same location, inline data is never offered
+	ranges := unsharedRanges(source, dest, 30)
+	expected := []byteRange{{0, 10}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, but was %v", expected, ranges)
+	}
+	if encoded := encodedLength(dest, ranges); encoded != 10 {
+		t.Errorf("Expected 10 encoded bytes, but was %d", encoded)
+	}
+}
+
+func TestDedupSizeAlignedToBlockSize(t *testing.T) {
+	files := []*storage.FileInformation{{Size: 10000, EqualSize: 10000}, {Size: 12000, EqualSize: 10000}}
+	if size := dedupSize(files, 4096); size != 8192 {
+		t.Errorf("Expected size 8192, but was %d", size)
+	}
+	files[1].Size = 10000
+	if size := dedupSize(files, 4096); size != 10000 {
+		t.Errorf("Expected the end of the files to be kept, but was %d", size)
+	}
+}
+
+func TestChunkSizeForLargeGroups(t *testing.T) {
+	if size := chunkSize(3, 4096); size != 22368256 {
+		t.Errorf("Expected a third of the maximum size aligned to the block size, but was %d", size)
+	}
+	// more files than maxSize/blockSize would give an empty request that never finishes
+	if size := chunkSize(2000, 65536); size != 65536 {
+		t.Errorf("Expected a single block for a large group, but was %d", size)
+	}
+}
+
+func TestHardlinksAreCollectedOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(original, make([]byte, 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := os.Link(original, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := storage.NewProgressLogStats()
+	stats.Start()
+	defer stats.Stop()
+	ctx := context{pathstore: storage.NewPathStorage(), stats: stats, fs: newFilesystems(false, func() storage.DedupInterface { return storage.NewMemoryBased() }), filter: newFilter(false), links: newHardlinks()}
+	collectFiles(ctx, -1, dir, 1)
+
+	if count := ctx.pathstore.FileCount(); count != 1 {
+		t.Fatalf("Expected one file, but was %d", count)
+	}
+	ctx.pathstore.ProcessFiles(func(filenr int32, path string) {
+		if aliases := ctx.links.aliasesOf(filenr); len(aliases) != 2 {
+			t.Errorf("Expected two aliases for %s, but was %v", path, aliases)
+		}
+	})
+	if skipped := stats.Report().Skipped[storage.SkippedHardLink]; skipped != 2 {
+		t.Errorf("Expected two files to be reported as hard links, but was %d", skipped)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Chooses the file of a group towards which the other files are deduplicated. The source keeps its extents, while the
+// extents of the other files are freed once nothing references them anymore. Extents that are also referenced from
+// outside the group, like from snapshots that are not scanned, are not freed, so the choice decides whether a run
+// frees space or just moves references around.
+type sourcePolicy struct {
+	name        string
+	description string
+	// returns the rank of each file, the file with the highest rank is the source. Ties are broken by the number of
+	// fragments.
+	rank func(ctx context, files []*storage.FileInformation) []int64
+}
+
+var sourcePolicies = []sourcePolicy{
+	{"fragments", "the file with the fewest fragments", func(ctx context, files []*storage.FileInformation) []int64 {
+		return make([]int64, len(files))
+	}},
+	{"shared", "the file of which the most data is already shared with the other files", rankByShared},
+	{"oldest", "the file in the oldest subvolume, like the first snapshot", rankBySubvolumeAge},
+	{"path", "a file matching a -sourcepath pattern", rankByPath},
+}
+
+func sourcePolicyNames() string {
+	names := make([]string, len(sourcePolicies))
+	for i, policy := range sourcePolicies {
+		names[i] = policy.name + " (" + policy.description + ")"
+	}
+	return strings.Join(names, ", ")
+}
+
+func sourcePolicyByName(name string) (*sourcePolicy, error) {
+	for i := range sourcePolicies {
+		if sourcePolicies[i].name == name {
+			return &sourcePolicies[i], nil
+		}
+	}
+	return nil, errors.Errorf("unknown source policy '%s', supported policies are: %s", name, sourcePolicyNames())
+}
+
+// Returns the index of the file that is chosen as the source by the policy of the context, the file with the fewest
+// fragments if there is no policy
+func (ctx context) chooseSource(files []*storage.FileInformation) int {
+	policy := ctx.source
+	if policy == nil {
+		policy = &sourcePolicies[0]
+	}
+	ranks := policy.rank(ctx, files)
+	best := 0
+	for i, file := range files {
+		if ranks[i] > ranks[best] || ranks[i] == ranks[best] && len(file.Fragments) < len(files[best].Fragments) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Ranks the files by the number of bytes that the other files of the group already share with them. Deduplicating
+// towards the most shared file needs the fewest new references. The number of references to each physical range is
+// counted once for the whole group, so large groups don't need to compare each pair of files.
+func rankByShared(ctx context, files []*storage.FileInformation) []int64 {
+	size := dedupSize(files, ctx.blockSize)
+	// the number of references changes at each boundary by the sum of the deltas
+	deltas := make(map[uint64]int64)
+	for _, file := range files {
+		forEachLocatedExtent(file, size, func(extent storage.Extent, length int64) {
+			deltas[extent.Start]++
+			deltas[extent.Start+uint64(length)]--
+		})
+	}
+	boundaries := make([]uint64, 0, len(deltas))
+	for boundary := range deltas {
+		boundaries = append(boundaries, boundary)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	// references[i] is the number of references to the range from boundaries[i] to boundaries[i+1]
+	references := make([]int64, len(boundaries))
+	var count int64
+	for i, boundary := range boundaries {
+		count += deltas[boundary]
+		references[i] = count
+	}
+
+	ranks := make([]int64, len(files))
+	for i, file := range files {
+		forEachLocatedExtent(file, size, func(extent storage.Extent, length int64) {
+			end := extent.Start + uint64(length)
+			for j := sort.Search(len(boundaries), func(j int) bool { return boundaries[j] >= extent.Start }); j < len(boundaries)-1 && boundaries[j] < end; j++ {
+				ranks[i] += (references[j] - 1) * int64(boundaries[j+1]-boundaries[j])
+			}
+		})
+	}
+	return ranks
+}
+
+// Calls f for each extent of the file up to the specified size that has a physical location, with its length up to
+// that size
+func forEachLocatedExtent(file *storage.FileInformation, size int64, f func(extent storage.Extent, length int64)) {
+	cursor := storage.NewExtentCursor(file)
+	for offset := int64(0); offset < size; {
+		extent := cursor.At(offset)
+		length := int64(extent.Length)
+		if length == 0 {
+			break
+		}
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+		if extent.Located() && !extent.Zero() {
+			f(extent, length)
+		}
+		offset += length
+	}
+}
+
+// Ranks the files by the age of their subvolume, the generation in which the subvolume was created. Files of which the
+// subvolume can't be determined have the lowest rank.
+func rankBySubvolumeAge(ctx context, files []*storage.FileInformation) []int64 {
+	ages := ctx.subvolumes
+	if ages == nil {
+		ages = newSubvolumeAges()
+	}
+	ranks := make([]int64, len(files))
+	for i, file := range files {
+		ranks[i] = ages.rank(ctx.pathstore.FilePath(file.Path))
+	}
+	return ranks
+}
+
+// Caches the rank of each subvolume by its device number, as each btrfs subvolume has its own device, so the subvolume
+// is only looked up once instead of for each file
+type subvolumeAges struct {
+	lock     sync.Mutex
+	byDevice map[uint64]int64
+}
+
+func newSubvolumeAges() *subvolumeAges {
+	return &subvolumeAges{byDevice: make(map[uint64]int64)}
+}
+
+// Returns the rank of the subvolume of the file, higher for older subvolumes
+func (a *subvolumeAges) rank(path string) int64 {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		log.Printf("Unable to determine the subvolume of %s: %v", path, err)
+		return math.MinInt64
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return math.MinInt64
+	}
+	device := uint64(stat.Dev)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if rank, ok := a.byDevice[device]; ok {
+		return rank
+	}
+	rank := int64(math.MinInt64)
+	if created, err := subvolumeCreation(path); err != nil {
+		log.Printf("Unable to determine the age of the subvolume of %s: %v", path, err)
+	} else {
+		rank = -int64(created)
+	}
+	a.byDevice[device] = rank
+	return rank
+}
+
+func subvolumeCreation(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	id, err := sys.SubvolumeID(f)
+	if err != nil {
+		return 0, err
+	}
+	return sys.SubvolumeCreation(f, id)
+}
+
+// Ranks the files by the first -sourcepath pattern they match, files that don't match any pattern have the lowest rank
+func rankByPath(ctx context, files []*storage.FileInformation) []int64 {
+	ranks := make([]int64, len(files))
+	for i, file := range files {
+		path := ctx.pathstore.FilePath(file.Path)
+		for j, pattern := range ctx.sourcePaths {
+			if pattern.match(path, false, nil) {
+				ranks[i] = int64(len(ctx.sourcePaths) - j)
+				break
+			}
+		}
+	}
+	return ranks
+}
+
+// Command line option with the patterns of the paths that are preferred as source, in order of preference
+type sourcePathOption struct {
+	patterns *[]condition
+}
+
+func (o sourcePathOption) String() string {
+	return ""
+}
+
+func (o sourcePathOption) Set(value string) error {
+	pattern, _, err := parseGlobCondition(value, "")
+	if err != nil {
+		return err
+	}
+	*o.patterns = append(*o.patterns, pattern)
+	return nil
+}
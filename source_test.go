@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sourceContext(t *testing.T, name string, paths ...string) context {
+	policy, err := sourcePolicyByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context{source: policy, blockSize: 10, pathstore: storage.NewPathStorage()}
+	for _, path := range paths {
+		if err := (sourcePathOption{&ctx.sourcePaths}).Set(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ctx
+}
+
+func equalFiles(files ...*storage.FileInformation) []*storage.FileInformation {
+	for _, file := range files {
+		file.EqualSize = file.Size
+	}
+	return files
+}
+
+func TestSourceWithFewestFragments(t *testing.T) {
+	files := equalFiles(fileWithFragments(40, 100, 20, 200, 20), fileWithFragments(40, 300, 40), fileWithFragments(40, 400, 40))
+	if source := (context{}).chooseSource(files); source != 1 {
+		t.Errorf("Expected the first file with a single fragment, but was %d", source)
+	}
+}
+
+func TestSourceSharedWithMostFiles(t *testing.T) {
+	// the second file is a copy of the third file, so deduplicating the first file towards them only adds references
+	files := equalFiles(fileWithFragments(40, 100, 40), fileWithFragments(40, 300, 20, 400, 20), fileWithFragments(40, 300, 20, 400, 20))
+	ctx := sourceContext(t, "shared")
+	if source := ctx.chooseSource(files); source != 1 {
+		t.Errorf("Expected the shared file, but was %d", source)
+	}
+	if source := sourceContext(t, "fragments").chooseSource(files); source != 0 {
+		t.Errorf("Expected the file with the fewest fragments, but was %d", source)
+	}
+}
+
+func TestSourceMatchingPath(t *testing.T) {
+	ctx := sourceContext(t, "path", "/data/live/**", "/snapshots/**")
+	root := ctx.pathstore.AddDir(-1, "/")
+	var files []*storage.FileInformation
+	for _, path := range []string{"backup/a", "snapshots/1/a", "data/live/a"} {
+		dir := root
+		for _, name := range strings.Split(filepath.Dir(path), "/") {
+			dir = ctx.pathstore.AddDir(dir, name)
+		}
+		file := fileWithFragments(40, 100, 40)
+		file.Path = ctx.pathstore.AddFile(dir, "a")
+		files = append(files, file)
+	}
+	files[2].Fragments = fileWithFragments(40, 100, 20, 200, 20).Fragments
+	if source := ctx.chooseSource(equalFiles(files...)); source != 2 {
+		t.Errorf("Expected the file matching the first pattern, but was %d", source)
+	}
+	if source := ctx.chooseSource(files[:2]); source != 1 {
+		t.Errorf("Expected the file matching the second pattern, but was %d", source)
+	}
+}
+
+// Adds the file with the given absolute path to the path store
+func addPath(pathstore storage.PathStorage, path string) int32 {
+	dir := pathstore.AddDir(-1, "/")
+	for _, name := range strings.Split(strings.Trim(filepath.Dir(path), "/"), "/") {
+		dir = pathstore.AddDir(dir, name)
+	}
+	return pathstore.AddFile(dir, filepath.Base(path))
+}
+
+func TestSourceKeptWhenNotDefragmented(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writablePath := filepath.Join(dir, "writable")
+	if err := ioutil.WriteFile(writablePath, make([]byte, 40), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := storage.NewProgressLogStats()
+	stats.Start()
+	defer stats.Stop()
+	ctx := sourceContext(t, "path", "/nonexistent/**")
+	ctx.stats, ctx.policy, ctx.minBpf = stats, policy(t, "bpf"), 1024
+	// the source chosen by the policy is in a read-only location, like a snapshot
+	source := fileWithFragments(40, 100, 20, 200, 20)
+	source.Path = addPath(ctx.pathstore, "/nonexistent/snapshot/file")
+	writable := fileWithFragments(40, 100, 20, 200, 20)
+	writable.Path = addPath(ctx.pathstore, writablePath)
+
+	files := reorderAndDefragIfNeeded(ctx, equalFiles(writable, source), true)
+	if files[0] != source {
+		t.Errorf("Expected the source chosen by the policy to be kept when the writable file is not defragmented")
+	}
+	if defrag := stats.Report().Defrag; len(defrag) != 1 || defrag[0].Path != writablePath || defrag[0].Result != storage.DefragNoact {
+		t.Errorf("Expected the writable file to be reported as not defragmented because of -noact, but was %+v", defrag)
+	}
+}
+
+func TestSubvolumeAgeCachedPerSubvolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	ages := newSubvolumeAges()
+	if first, second := ages.rank(paths[0]), ages.rank(paths[1]); first != second {
+		t.Errorf("Expected files in the same subvolume to have the same rank, but was %d and %d", first, second)
+	}
+	if len(ages.byDevice) != 1 {
+		t.Errorf("Expected the subvolume to be looked up once, but found %d entries", len(ages.byDevice))
+	}
+}
+
+func TestSharedRankCountsReferences(t *testing.T) {
+	files := equalFiles(fileWithFragments(40, 300, 40), fileWithFragments(40, 100, 20, 200, 20), fileWithFragments(40, 100, 40), fileWithFragments(40, 100, 20, 200, 20))
+	ranks := rankByShared(sourceContext(t, "shared"), files)
+	// the first extent of the second file is referenced by three files, the second by two
+	if expected := []int64{0, 2*20 + 1*20, 2 * 20, 2*20 + 1*20}; !reflect.DeepEqual(ranks, expected) {
+		t.Errorf("Expected ranks %v, but was %v", expected, ranks)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// btrfs needs metadata space for the new extents of a defragmented file, either free in the metadata chunks or
+	// unallocated for new chunks
+	metadataMinimum = 256 * 1024 * 1024
+	// number of times the filesystem is synced while waiting for space, with a doubling delay between the rounds
+	spaceSyncRounds = 4
+	spaceSyncDelay  = time.Second
+)
+
+// Keeps a reserve of free space while defragmenting. A defragmented file doesn't share its extents anymore, so until its
+// copies are relinked the data is stored twice. On a nearly full filesystem this could fail with ENOSPC halfway the run.
+type spaceReserve struct {
+	bytes int64
+}
+
+// Returns why defragmenting the given number of bytes would use the reserve, or an empty string if there is enough space
+func (r *spaceReserve) shortage(space sys.Space, needed int64) string {
+	if int64(space.Available)-needed < r.bytes {
+		return fmt.Sprintf("%s available, %s needed while keeping a reserve of %s", formatBytes(int64(space.Available)), formatBytes(needed), formatBytes(r.bytes))
+	}
+	if space.Btrfs && space.MetadataFree+space.Unallocated < metadataMinimum {
+		return fmt.Sprintf("%s free for metadata and %s unallocated", formatBytes(int64(space.MetadataFree)), formatBytes(int64(space.Unallocated)))
+	}
+	return ""
+}
+
+// Returns why the file can not be defragmented without using the reserve, or an empty string if it can. When the space
+// is short, the defragmentation pauses for a few rounds in which the filesystem commits its transaction and the space is
+// checked again. Committing frees the old extents of the files that were defragmented and relinked before, but btrfs
+// may need some time to clean them up, so the delay between the rounds doubles each time.
+func (r *spaceReserve) check(path string, needed int64) string {
+	if r == nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Sprintf("unable to check the free space: %v", err)
+	}
+	defer f.Close()
+	space, err := sys.SpaceOf(f)
+	if err != nil {
+		return fmt.Sprintf("unable to check the free space: %v", err)
+	}
+	shortage := r.shortage(*space, needed)
+	if shortage == "" || !space.Btrfs {
+		return shortage
+	}
+	log.Printf("Not enough free space to defragment %s (%s), waiting for the filesystem to free unused extents", path, shortage)
+	delay := spaceSyncDelay
+	for round := 0; round < spaceSyncRounds && shortage != ""; round++ {
+		if round > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err := sys.SyncFilesystem(f); err != nil {
+			log.Printf("Unable to sync the filesystem: %v", err)
+			return shortage
+		}
+		if space, err = sys.SpaceOf(f); err != nil {
+			return fmt.Sprintf("unable to check the free space: %v", err)
+		}
+		shortage = r.shortage(*space, needed)
+	}
+	return shortage
+}
+
+// Logs the free space of the filesystems of the given paths before the run, with a warning if the reserve is already
+// used
+func (r *spaceReserve) preflight(paths []string) {
+	if r == nil {
+		return
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Unable to check the free space of %s: %v", path, err)
+			continue
+		}
+		space, err := sys.SpaceOf(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Unable to check the free space of %s: %v", path, err)
+			continue
+		}
+		if space.Btrfs {
+			log.Printf("Free space of %s: %s available, %s unallocated, %s free for metadata", path, formatBytes(int64(space.Available)), formatBytes(int64(space.Unallocated)), formatBytes(int64(space.MetadataFree)))
+		} else {
+			log.Printf("Free space of %s: %s available", path, formatBytes(int64(space.Available)))
+		}
+		if shortage := r.shortage(*space, 0); shortage != "" {
+			log.Printf("WARNING: the free space of %s is below the reserve (%s), files will not be defragmented until space is freed", path, shortage)
+		}
+	}
+}
+
+// Logs and reports that the file is not defragmented because of the shortage of free space
+func (ctx context) reportShortage(path string, fragcount int, decision defragDecision, shortage string) {
+	log.Printf("File %s has %s, but will not be defragmented: %s", path, decision.reason, shortage)
+	ctx.stats.Defragmented(storage.DefragAction{Path: path, FragmentsBefore: fragcount, Result: storage.DefragNoSpace, Reason: decision.reason, Error: shortage})
+}
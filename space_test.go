@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/sys"
+	"testing"
+)
+
+const gb = 1024 * 1024 * 1024
+
+func TestReserveKeptWhileDefragmenting(t *testing.T) {
+	reserve := &spaceReserve{bytes: 1 * gb}
+	space := sys.Space{Btrfs: true, Available: 3 * gb, Unallocated: 2 * gb, MetadataFree: 100 * 1024 * 1024}
+
+	if shortage := reserve.shortage(space, 2*gb); shortage != "" {
+		t.Errorf("Expected enough space for 2G, but was: %s", shortage)
+	}
+	if shortage := reserve.shortage(space, 2*gb+1); shortage == "" {
+		t.Errorf("Expected the reserve to be used for more than 2G")
+	}
+}
+
+func TestReserveRequiresMetadataSpace(t *testing.T) {
+	reserve := &spaceReserve{bytes: 1 * gb}
+	space := sys.Space{Btrfs: true, Available: 10 * gb, MetadataFree: 100 * 1024 * 1024}
+	if shortage := reserve.shortage(space, 0); shortage == "" {
+		t.Errorf("Expected a shortage without unallocated space for metadata")
+	}
+	space.Btrfs = false
+	if shortage := reserve.shortage(space, 0); shortage != "" {
+		t.Errorf("Expected the metadata space to be ignored for other filesystems, but was: %s", shortage)
+	}
+}
+
+func TestNoReserveWithoutDefragmentation(t *testing.T) {
+	var reserve *spaceReserve
+	if shortage := reserve.check("/nonexistent", 1*gb); shortage != "" {
+		t.Errorf("Expected no check without a reserve, but was: %s", shortage)
+	}
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/bertbaron/btrdedup/sys"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	cacheMagic   = "btrdedup-cache\n"
+	cacheVersion = 6
+
+	// the fragments of the file are outdated, but the path and checksum are still valid
+	cacheStale uint32 = 1
+)
+
+// Identifies a version of a file. Any change to the content or the metadata of a file will change its key. The transid
+// of the inode also changes when the extents of the file are deduplicated or defragmented by other tools, which don't
+// update the mtime or ctime. A cached entry for the key can still become stale if the physical layout of the file is
+// changed by relocating its extents, like by balancing.
+type CacheKey struct {
+	Device  uint64
+	Inode   uint64
+	Size    int64
+	Mtime   int64  // nanoseconds since the epoch
+	Ctime   int64  // nanoseconds since the epoch
+	Transid uint64 // 0 if it can't be read, like on other filesystems or without CAP_SYS_ADMIN
+}
+
+type cacheRecord struct {
+	Key           CacheKey
+	Scanned       int64 // seconds since the epoch
+	Csum          [MaxHashSize]byte
+	Flags         uint32
+	FragmentCount uint32
+	PathLength    uint32
+}
+
+type cacheEntry struct {
+	record    cacheRecord
+	fragments []sys.Fragment
+	path      string
+	seen      bool
+}
+
+type fileKey struct {
+	key  CacheKey
+	path string
+	hit  bool
+}
+
+// Persistent cache with the fragments and checksums of files from previous runs. Files for which the cache contains
+// an entry do not need to be scanned again.
+//
+// Entries are invalidated when:
+//   - the file changes in any way that modifies its size, mtime, ctime or the transid of its inode
+//   - the file is deduplicated or defragmented by btrdedup (see Invalidate). The path and checksum of the file remain
+//     available, see Partners
+//   - the entry is older than the maximum age, which can be used to rescan files periodically to detect changes to the
+//     physical layout by balance
+//   - the file is not seen during a complete run, which means that it is removed or not part of the scanned paths
+//     anymore
+//
+// Stale entries never lead to data corruption, because the kernel verifies that the data is equal before
+// deduplicating. They may only cause data to be deduplicated again or not be deduplicated at all.
+//
+// Access is thread-safe.
+//
+// The cache also records the generations up to which subvolumes are processed for incremental runs.
+type ScanCache struct {
+	lock        sync.Mutex
+	path        string
+	maxAge      time.Duration
+	hashName    string
+	entries     map[CacheKey]*cacheEntry
+	keys        map[int32]fileKey
+	generations map[string]uint64
+}
+
+// Loads the cache from the given file. An empty cache is returned if the file does not exist or if it contains
+// checksums of another hash algorithm. A maxAge of 0 means that entries never expire.
+func LoadScanCache(path string, maxAge time.Duration, hashName string) (*ScanCache, error) {
+	cache := &ScanCache{path: path, maxAge: maxAge, hashName: hashName, entries: make(map[CacheKey]*cacheEntry), keys: make(map[int32]fileKey), generations: make(map[string]uint64)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("Cache file %s does not exist yet, it will be created", path)
+		return cache, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open cache file failed")
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	magic := make([]byte, len(cacheMagic))
+	var version uint32
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != cacheMagic {
+		return nil, errors.Errorf("%s is not a btrdedup cache file", path)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return nil, errors.Wrap(err, "reading cache version failed")
+	}
+	if version != cacheVersion {
+		log.Printf("Ignoring cache file %s with version %d, expected version %d", path, version, cacheVersion)
+		return cache, nil
+	}
+	storedHash, err := readString(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cache hash algorithm failed")
+	}
+	if storedHash != hashName {
+		log.Printf("Ignoring cache file %s with checksums of hash algorithm %s, expected %s", path, storedHash, hashName)
+		return cache, nil
+	}
+	var generationCount uint32
+	if err := binary.Read(reader, binary.LittleEndian, &generationCount); err != nil {
+		return nil, errors.Wrap(err, "reading cache generations failed")
+	}
+	for i := uint32(0); i < generationCount; i++ {
+		subvolume, err := readString(reader)
+		var generation uint64
+		if err == nil {
+			err = binary.Read(reader, binary.LittleEndian, &generation)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading cache generations failed")
+		}
+		cache.generations[subvolume] = generation
+	}
+	for {
+		entry := new(cacheEntry)
+		if err := binary.Read(reader, binary.LittleEndian, &entry.record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "reading cache entry failed")
+		}
+		entry.fragments = make([]sys.Fragment, entry.record.FragmentCount)
+		if err := binary.Read(reader, binary.LittleEndian, entry.fragments); err != nil {
+			return nil, errors.Wrap(err, "reading cache entry failed")
+		}
+		path := make([]byte, entry.record.PathLength)
+		if _, err := io.ReadFull(reader, path); err != nil {
+			return nil, errors.Wrap(err, "reading cache entry failed")
+		}
+		entry.path = string(path)
+		if !cache.expired(entry) {
+			cache.entries[entry.record.Key] = entry
+		}
+	}
+	log.Printf("Loaded %d entries from cache file %s", len(cache.entries), path)
+	return cache, nil
+}
+
+func readString(reader io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return string(data), err
+}
+
+func writeString(writer io.Writer, s string) {
+	binary.Write(writer, binary.LittleEndian, uint32(len(s)))
+	io.WriteString(writer, s)
+}
+
+func (c *ScanCache) expired(entry *cacheEntry) bool {
+	return c.maxAge > 0 && time.Since(time.Unix(entry.record.Scanned, 0)) > c.maxAge
+}
+
+func keyOf(stat *syscall.Stat_t) CacheKey {
+	return CacheKey{
+		Device: uint64(stat.Dev),
+		Inode:  uint64(stat.Ino),
+		Size:   int64(stat.Size),
+		Mtime:  stat.Mtim.Nano(),
+		Ctime:  stat.Ctim.Nano(),
+	}
+}
+
+func keyOfPath(path string) (CacheKey, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CacheKey{}, false
+	}
+	defer f.Close()
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return CacheKey{}, false
+	}
+	key := keyOf(&stat)
+	key.Transid, _ = sys.InodeTransid(f, key.Inode)
+	return key, true
+}
+
+// Returns the cached file information for the given file, or false if the file needs to be scanned
+func (c *ScanCache) Lookup(filenr int32, path string) (*FileInformation, bool) {
+	key, ok := keyOfPath(path)
+	if !ok {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, hit := c.entries[key]
+	hit = hit && entry.record.Flags&cacheStale == 0
+	c.keys[filenr] = fileKey{key, path, hit}
+	if !hit {
+		return nil, false
+	}
+	entry.seen = true
+	fragments := make([]sys.Fragment, len(entry.fragments))
+	copy(fragments, entry.fragments)
+	return &FileInformation{Path: filenr, Size: key.Size, Fragments: fragments, Csum: entry.record.Csum, HasCsum: true}, true
+}
+
+// Stores the fragments and checksum of a file that was scanned after a failed lookup. Should only be called after the
+// checksum is calculated.
+func (c *ScanCache) Update(file *FileInformation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fk, ok := c.keys[file.Path]
+	if !ok || fk.hit || file.Error {
+		return
+	}
+	fragments := make([]sys.Fragment, len(file.Fragments))
+	copy(fragments, file.Fragments)
+	record := cacheRecord{Key: fk.key, Scanned: time.Now().Unix(), Csum: file.Csum, FragmentCount: uint32(len(fragments)), PathLength: uint32(len(fk.path))}
+	c.entries[fk.key] = &cacheEntry{record: record, fragments: fragments, path: fk.path, seen: true}
+}
+
+// Marks the entry of a file of which the physical layout is (possibly) modified as stale, so it will be scanned again
+func (c *ScanCache) Invalidate(filenr int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if fk, ok := c.keys[filenr]; ok {
+		if entry, ok := c.entries[fk.key]; ok {
+			entry.record.Flags |= cacheStale
+			entry.record.FragmentCount = 0
+			entry.fragments = nil
+		}
+	}
+}
+
+// Returns the paths of all cached files with one of the given checksums for the first block. These files are
+// potential duplicates of files with the same checksum.
+func (c *ScanCache) Partners(csums map[[MaxHashSize]byte]bool) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var paths []string
+	for _, entry := range c.entries {
+		if csums[entry.record.Csum] {
+			paths = append(paths, entry.path)
+		}
+	}
+	return paths
+}
+
+// Returns the generation up to which the subvolume with the given path is processed, or false if it is not known
+func (c *ScanCache) Generation(subvolume string) (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	generation, ok := c.generations[subvolume]
+	return generation, ok
+}
+
+// Records the generation up to which the subvolume with the given path is processed
+func (c *ScanCache) SetGeneration(subvolume string, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generations[subvolume] = generation
+}
+
+// Writes the entries to the cache file. If complete is true, all files on the scanned paths are seen during this run
+// and the entries of files that are not seen are removed. Otherwise they are kept.
+func (c *ScanCache) Save(complete bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	tmpname := c.path + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return errors.Wrap(err, "create cache file failed")
+	}
+	writer := bufio.NewWriter(f)
+	writer.WriteString(cacheMagic)
+	binary.Write(writer, binary.LittleEndian, uint32(cacheVersion))
+	writeString(writer, c.hashName)
+	binary.Write(writer, binary.LittleEndian, uint32(len(c.generations)))
+	for subvolume, generation := range c.generations {
+		writeString(writer, subvolume)
+		binary.Write(writer, binary.LittleEndian, generation)
+	}
+	count := 0
+	for _, entry := range c.entries {
+		if complete && !entry.seen {
+			continue
+		}
+		binary.Write(writer, binary.LittleEndian, &entry.record)
+		binary.Write(writer, binary.LittleEndian, entry.fragments)
+		io.WriteString(writer, entry.path)
+		count++
+	}
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing cache file failed")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "writing cache file failed")
+	}
+	if err := os.Rename(tmpname, c.path); err != nil {
+		return errors.Wrap(err, "replacing cache file failed")
+	}
+	log.Printf("Saved %d entries to cache file %s", count, c.path)
+	return nil
+}
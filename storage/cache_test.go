@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"github.com/bertbaron/btrdedup/sys"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "cache")
+
+	cache, err := LoadScanCache(cachePath, 0, "xxh3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Lookup(1, path); ok {
+		t.Fatal("Expected a cache miss for an empty cache")
+	}
+	file := FileInformation{Path: 1, Size: 4096, Fragments: []sys.Fragment{{Logical: 0, Start: 8192, Length: 4096}}}
+	file.Csum[0] = 42
+	cache.Update(&file)
+	if err := cache.Save(true); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = LoadScanCache(cachePath, 0, "xxh3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := cache.Lookup(7, path)
+	if !ok {
+		t.Fatal("Expected a cache hit")
+	}
+	file.Path = 7
+	file.HasCsum = true
+	if !equalsInfo(file, *cached) {
+		t.Errorf("Expected: %+v, but was: %+v", file, cached)
+	}
+
+	cache.Invalidate(7)
+	if _, ok := cache.Lookup(7, path); ok {
+		t.Error("Expected a cache miss after invalidation")
+	}
+	partners := cache.Partners(map[[MaxHashSize]byte]bool{file.Csum: true})
+	if len(partners) != 1 || partners[0] != path {
+		t.Errorf("Expected %s as partner, but was %v", path, partners)
+	}
+}
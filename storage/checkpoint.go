@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Saving and restoring the state of a run, so an interrupted run can be resumed. The files are written with the same
+// records as the temporary files in low memory mode.
+
+const (
+	pathRecordDir  = 'd'
+	pathRecordFile = 'f'
+)
+
+// Saves the state after the given pass, so it can be restored with Restore
+func (state *MemoryBased) Save(name string, pass int) error {
+	return WriteAtomicallyWith(name, 0600, func(writer *bufio.Writer) error {
+		if pass >= 3 {
+			for i, group := range state.groups {
+				key := numberKey(uint64(i))
+				for _, file := range group {
+					if err := writeRecord(writer, key, serialize(*file, MaxHashSize)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		for _, file := range state.files {
+			var key []byte
+			if pass == 2 {
+				key = file.Csum[:]
+			}
+			if err := writeRecord(writer, key, serialize(*file, MaxHashSize)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Restores the state that is saved after the given pass, the next pass can be started after that
+func (state *MemoryBased) Restore(name string, pass int) error {
+	state.files, state.groups = nil, nil
+	return readStateFile(name, pass == 2, func(files []*FileInformation) {
+		if pass >= 3 {
+			state.groups = append(state.groups, files)
+		} else {
+			state.files = append(state.files, files...)
+		}
+	})
+}
+
+// Saves the state after the given pass, so it can be restored with Restore
+func (state *FileBased) Save(name string, pass int) error {
+	return copyFile(state.infilename, name)
+}
+
+// Restores the state that is saved after the given pass, the next pass can be started after that. The saved file is
+// used as input for the next pass, so it must not be removed before that pass has ended.
+func (state *FileBased) Restore(name string, pass int) error {
+	if _, err := os.Stat(name); err != nil {
+		return errors.Wrap(err, "restoring state failed")
+	}
+	state.infilename = name
+	return nil
+}
+
+func readStateFile(name string, keyIsHash bool, receiver func([]*FileInformation)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "restoring state failed")
+	}
+	defer f.Close()
+	return errors.Wrapf(readPartitions(bufio.NewReader(f), keyIsHash, receiver), "reading %s failed", name)
+}
+
+// Replaces the file with a copy of the source, hard linked if possible
+func copyFile(source, name string) error {
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(source, tmp); err != nil {
+		in, err := os.Open(source)
+		if err != nil {
+			return errors.Wrap(err, "copying state failed")
+		}
+		defer in.Close()
+		err = WriteAtomicallyWith(name, 0600, func(writer *bufio.Writer) error {
+			_, err := io.Copy(writer, in)
+			return err
+		})
+		return errors.Wrap(err, "copying state failed")
+	}
+	return errors.Wrap(os.Rename(tmp, name), "copying state failed")
+}
+
+// Saves the paths to the file with the given name
+func (store *pathstore) Save(name string) error {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return WriteAtomicallyWith(name, 0600, func(writer *bufio.Writer) error {
+		for _, nodes := range []struct {
+			kind  byte
+			nodes []pathnode
+		}{{pathRecordDir, store.dirs}, {pathRecordFile, store.files}} {
+			for _, node := range nodes.nodes {
+				payload := appendVarint(nil, int64(node.parent))
+				if err := writeRecord(writer, []byte{nodes.kind}, append(payload, node.name...)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Loads the paths saved with the Save method of a PathStorage. The numbers of the files and directories are the same
+// as in the saved storage.
+func LoadPathStorage(name string) (PathStorage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading paths failed")
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	store := new(pathstore)
+	for {
+		key, payload, err := readRecord(reader)
+		if err == io.EOF {
+			return store, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s failed", name)
+		}
+		d := &decoder{data: payload}
+		node := pathnode{parent: int32(d.varint())}
+		if d.err != nil || len(key) != 1 {
+			return nil, errors.Errorf("invalid path record in %s", name)
+		}
+		node.name = string(d.data)
+		switch key[0] {
+		case pathRecordDir:
+			store.dirs = append(store.dirs, node)
+		case pathRecordFile:
+			store.files = append(store.files, node)
+		default:
+			return nil, errors.Errorf("invalid path record in %s", name)
+		}
+	}
+}
+
+// Appends groups of files to a file, to save the groups found so far during pass 3
+type GroupWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	count  uint64
+}
+
+// Opens the file with groups, keeping only the given number of bytes that have been synced before. Returns the groups
+// that are kept.
+func OpenGroupWriter(name string, length int64) (*GroupWriter, [][]*FileInformation, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open group file failed")
+	}
+	var groups [][]*FileInformation
+	err = f.Truncate(length)
+	if err == nil {
+		err = readPartitions(bufio.NewReader(io.LimitReader(f, length)), false, func(files []*FileInformation) {
+			groups = append(groups, files)
+		})
+	}
+	if err == nil {
+		_, err = f.Seek(length, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "reading %s failed", name)
+	}
+	return &GroupWriter{file: f, writer: bufio.NewWriter(f), count: uint64(len(groups))}, groups, nil
+}
+
+func (w *GroupWriter) Add(group []*FileInformation) error {
+	key := numberKey(w.count)
+	w.count++
+	for _, file := range group {
+		if err := writeRecord(w.writer, key, serialize(*file, MaxHashSize)); err != nil {
+			return errors.Wrap(err, "writing group failed")
+		}
+	}
+	return nil
+}
+
+// Writes the groups to disk, returns the length of the file
+func (w *GroupWriter) Sync() (int64, error) {
+	if err := w.writer.Flush(); err != nil {
+		return 0, errors.Wrap(err, "writing groups failed")
+	}
+	if err := w.file.Sync(); err != nil {
+		return 0, errors.Wrap(err, "writing groups failed")
+	}
+	return w.file.Seek(0, io.SeekCurrent)
+}
+
+func (w *GroupWriter) Close() error {
+	return w.file.Close()
+}
+
+// Replaces the file with the data, such that readers never see a partially written file
+func WriteAtomically(name string, data []byte, mode os.FileMode) error {
+	return WriteAtomicallyWith(name, mode, func(writer *bufio.Writer) error {
+		_, err := writer.Write(data)
+		return err
+	})
+}
+
+// Like WriteAtomically, with the data written by the write function
+func WriteAtomicallyWith(name string, mode os.FileMode, write func(writer *bufio.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file failed")
+	}
+	writer := bufio.NewWriter(f)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "writing %s failed", name)
+	}
+	return nil
+}
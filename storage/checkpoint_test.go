@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"github.com/bertbaron/btrdedup/sys"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func checkpointDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func checkpointFile(path int32, csum byte) *FileInformation {
+	file := &FileInformation{Path: path, Size: 4096, Fragments: []sys.Fragment{{Start: uint64(path) * 4096, Length: 4096}}}
+	file.Csum[0] = csum
+	return file
+}
+
+func TestMemoryBasedSaveAndRestore(t *testing.T) {
+	dir := checkpointDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "state")
+
+	state := NewMemoryBased()
+	state.files = []*FileInformation{checkpointFile(0, 1), checkpointFile(1, 1), checkpointFile(2, 2)}
+	if err := state.Save(name, 2); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryBased()
+	if err := restored.Restore(name, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.files, state.files) {
+		t.Errorf("Expected %v, but was %v", state.files, restored.files)
+	}
+
+	state.groups = [][]*FileInformation{state.files[:2], state.files[2:]}
+	if err := state.Save(name, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(name, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.groups) != 2 || len(restored.groups[0]) != 2 || restored.groups[1][0].Path != 2 {
+		t.Errorf("Expected the groups to be restored, but was %v", restored.groups)
+	}
+}
+
+func TestPathStorageSaveAndLoad(t *testing.T) {
+	dir := checkpointDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "paths")
+
+	store := NewPathStorage()
+	root := store.AddDir(-1, "/mnt")
+	store.AddFile(root, "a")
+	store.AddFile(store.AddDir(root, "b"), "c")
+	if err := store.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPathStorage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.FileCount() != 2 || loaded.FilePath(0) != "/mnt/a" || loaded.FilePath(1) != "/mnt/b/c" {
+		t.Errorf("Expected the same paths, but was %d files", loaded.FileCount())
+	}
+}
+
+func TestGroupWriterKeepsSyncedGroups(t *testing.T) {
+	dir := checkpointDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "groups")
+
+	writer, _, err := OpenGroupWriter(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Add([]*FileInformation{checkpointFile(0, 1), checkpointFile(1, 1)})
+	length, err := writer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not synced, so lost when the run is interrupted
+	writer.Add([]*FileInformation{checkpointFile(2, 2), checkpointFile(3, 2)})
+	writer.Sync()
+	writer.Close()
+
+	writer, groups, err := OpenGroupWriter(name, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][1].Path != 1 {
+		t.Fatalf("Expected the first group, but was %v", groups)
+	}
+	writer.Add([]*FileInformation{checkpointFile(4, 3), checkpointFile(5, 3)})
+	length, _ = writer.Sync()
+	writer.Close()
+	if _, groups, _ = OpenGroupWriter(name, length); len(groups) != 2 || groups[1][0].Path != 4 {
+		t.Errorf("Expected the new group to be appended, but was %v", groups)
+	}
+}
@@ -3,27 +3,33 @@ package storage
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"encoding/binary"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"strconv"
-	"strings"
-	"fmt"
+	"sync"
+	"io"
 	"github.com/bertbaron/btrdedup/sys"
 	"github.com/pkg/errors"
 )
 
 type FileBased struct {
+	lock       sync.Mutex
 	outfile    *os.File
 	writer     *bufio.Writer
 	infilename string
+	groupCount int64
+	// size of the checksums in bytes
+	hashSize   int
+	options    SortOptions
+	// the temporary files that are created, removed by Close
+	tempFiles  []string
 }
 
-// Creates a file based storage instance
-func NewFileBased() *FileBased {
-	return new(FileBased)
+// Creates a file based storage instance for checksums of the given size. The temporary files are sorted with the
+// given options.
+func NewFileBased(hashSize int, options SortOptions) *FileBased {
+	return &FileBased{hashSize: hashSize, options: options}
 }
 
 // ** PASS 1 **
@@ -32,14 +38,20 @@ func (state *FileBased) StartPass1() {
 }
 
 func (state *FileBased) AddFile(file FileInformation) {
-	prefix := strconv.FormatInt(int64(file.PhysicalOffset()), 36)
-	writeFileInfo(prefix, file, state.writer)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	key := numberKey(file.PhysicalOffset())
+	if !file.FirstBlockShareable() {
+		// make the key unique, so the file gets its own partition
+		key = append(key, numberKey(uint64(file.Path))...)
+	}
+	writeFileInfo(key, file, state.hashSize, state.writer)
 
 }
 
 func (state *FileBased) EndPass1() {
 	closeWriterAndSaveFilename(state)
-	sortFile(state.infilename)
+	sortStateFile(state)
 }
 
 // ** PASS 2 **
@@ -48,43 +60,81 @@ func (state *FileBased) StartPass2() {
 	initWriter(state)
 }
 
-func (state *FileBased) PartitionOnOffset(receiver func(files []*FileInformation) bool) {
-	partitionFile(state.infilename, false, func(files []*FileInformation) {
-		if receiver(files) {
+func (state *FileBased) PartitionOnOffset(jobs int, receiver func(files []*FileInformation) bool) {
+	w := newWindow(jobs, receiver, func(files []*FileInformation, ok bool) {
+		if ok {
 			for _, file := range files {
-				prefix := base64.StdEncoding.EncodeToString(file.Csum[:])
-				writeFileInfo(prefix, *file, state.writer)
+				writeFileInfo(file.Csum[:state.hashSize], *file, state.hashSize, state.writer)
 			}
 		}
 	})
+	partitionFile(state.infilename, false, w.add)
+	w.flush()
+}
 
+func (state *FileBased) ScanOnOffset(receiver func(files []*FileInformation)) {
+	partitionFile(state.infilename, false, receiver)
 }
 
 func (state *FileBased) EndPass2() {
 	closeWriterAndSaveFilename(state)
-	sortFile(state.infilename)
+	sortStateFile(state)
 }
 
 // ** PASS 3 **
 
-func (state *FileBased) StartPass3() {}
+func (state *FileBased) StartPass3() {
+	initWriter(state)
+}
 
-func (state *FileBased) PartitionOnHash(receiver func(files []*FileInformation)) {
-	partitionFile(state.infilename, true, receiver)
+func (state *FileBased) PartitionOnHash(receiver func(files []*FileInformation) [][]*FileInformation) {
+	partitionFile(state.infilename, true, func(files []*FileInformation) {
+		for _, group := range receiver(files) {
+			// groups are written in order, so there is no need to sort the output
+			key := numberKey(uint64(state.groupCount))
+			state.groupCount++
+			for _, file := range group {
+				writeFileInfo(key, *file, state.hashSize, state.writer)
+			}
+		}
+	})
 }
 
-func (state *FileBased) EndPass3() {}
+func (state *FileBased) EndPass3() {
+	closeWriterAndSaveFilename(state)
+}
+
+// ** PASS 4 **
+
+func (state *FileBased) StartPass4() {}
+
+func (state *FileBased) PartitionOnContent(receiver func(files []*FileInformation)) {
+	partitionFile(state.infilename, false, receiver)
+}
+
+func (state *FileBased) EndPass4() {}
+
+func (state *FileBased) Close() {
+	if state.outfile != nil {
+		state.outfile.Close()
+	}
+	for _, name := range state.tempFiles {
+		os.Remove(name)
+	}
+	state.tempFiles = nil
+}
 
 // ** private functions **
 
 func initWriter(state *FileBased) {
 	var err error
-	state.outfile, err = ioutil.TempFile("", "btrdedup")
+	state.outfile, err = ioutil.TempFile(state.options.TempDir, "btrdedup")
 	if err != nil {
 		log.Fatalf("Unable to create temprary file")
 	}
 
 	log.Printf("Writing to %s", state.outfile.Name())
+	state.tempFiles = append(state.tempFiles, state.outfile.Name())
 	state.writer = bufio.NewWriter(state.outfile)
 }
 
@@ -101,136 +151,200 @@ func bool2int(b bool) int64 {
 	return 0
 }
 
-func writeInt(buff *bytes.Buffer, value int64, size int) {
-	for i := 0; i < size; i++ {
-		buff.WriteByte(byte(value & 0xFF))
-		value >>= 8
+const (
+	flagError   = 1
+	flagHasCsum = 2
+)
+
+// Encodes the file information. Integers are written as varints and the fragments are delta encoded, because the
+// fragments of a file are usually close to each other.
+func serialize(fileInfo FileInformation, hashSize int) []byte {
+	buf := make([]byte, 0, 32+len(fileInfo.Fragments)*8+hashSize)
+	buf = appendVarint(buf, int64(fileInfo.Path))
+	flags := bool2int(fileInfo.Error) * flagError
+	flags |= bool2int(fileInfo.HasCsum) * flagHasCsum
+	buf = append(buf, byte(flags))
+	buf = appendVarint(buf, fileInfo.Size)
+	buf = appendVarint(buf, fileInfo.EqualSize)
+	buf = appendUvarint(buf, uint64(len(fileInfo.Fragments)))
+	var logical, physical uint64
+	for _, frag := range fileInfo.Fragments {
+		buf = appendVarint(buf, int64(frag.Logical-logical))
+		buf = appendVarint(buf, int64(frag.Start-physical))
+		buf = appendUvarint(buf, frag.Length)
+		buf = appendUvarint(buf, uint64(frag.Flags))
+		logical, physical = frag.Logical+frag.Length, frag.Start+frag.Length
 	}
+	if fileInfo.HasCsum {
+		buf = append(buf, byte(hashSize))
+		buf = append(buf, fileInfo.Csum[:hashSize]...)
+	}
+	return buf
 }
 
-func readInt(buff *bytes.Buffer, size int) int64 {
-	value := int64(0)
-	for i := 0; i < size; i++ {
-		byte, err := buff.ReadByte()
-		if err != nil {
-			panic(err)
+func deserialize(data []byte) (*FileInformation, error) {
+	d := &decoder{data: data}
+	fileInfo := new(FileInformation)
+	fileInfo.Path = int32(d.varint())
+	flags := d.byte()
+	fileInfo.Error = flags&flagError != 0
+	fileInfo.HasCsum = flags&flagHasCsum != 0
+	fileInfo.Size = d.varint()
+	fileInfo.EqualSize = d.varint()
+	frags := d.uvarint()
+	if d.err == nil && frags > uint64(len(d.data)) {
+		d.err = errors.Errorf("invalid number of fragments %d", frags)
+	}
+	if d.err == nil {
+		fileInfo.Fragments = make([]sys.Fragment, frags)
+	}
+	var logical, physical uint64
+	for i := range fileInfo.Fragments {
+		frag := &fileInfo.Fragments[i]
+		frag.Logical = logical + uint64(d.varint())
+		frag.Start = physical + uint64(d.varint())
+		frag.Length = d.uvarint()
+		frag.Flags = uint32(d.uvarint())
+		logical, physical = frag.Logical+frag.Length, frag.Start+frag.Length
+	}
+	if fileInfo.HasCsum {
+		hashSize := int(d.byte())
+		if hashSize > MaxHashSize {
+			d.fail(errors.Errorf("invalid checksum size %d", hashSize))
 		}
-		value = value | (int64(byte) << (uint(i) * 8))
+		copy(fileInfo.Csum[:], d.bytes(hashSize))
 	}
-	return value
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "failed to parse file information")
+	}
+	return fileInfo, nil
 }
 
-func serialize(fileInfo FileInformation) string {
-	buf := new(bytes.Buffer)
-	writeInt(buf, int64(fileInfo.Path), 4)
-	writeInt(buf, bool2int(fileInfo.Error), 1)
-	writeInt(buf, fileInfo.Size, 8)
-	writeInt(buf, int64(len(fileInfo.Fragments)), 4)
-	for _, frag := range fileInfo.Fragments {
-		writeInt(buf, int64(frag.Logical), 8)
-		writeInt(buf, int64(frag.Start), 8)
-		writeInt(buf, int64(frag.Length), 8)
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], value)]...)
+}
+
+func appendVarint(buf []byte, value int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], value)]...)
+}
+
+// Reads values from a serialized record, the first error is kept and further reads return zero values
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
 	}
-	return base64.StdEncoding.EncodeToString(buf.Bytes())
+	d.data = nil
 }
 
-func deserialize(line string) (fileInfo *FileInformation, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("pkg: %v", r)
-			}
-			err = errors.Wrapf(err, "Failed to parse %v", line)
-		}
-	}()
+func (d *decoder) uvarint() uint64 {
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(errors.New("invalid varint"))
+		return 0
+	}
+	d.data = d.data[n:]
+	return value
+}
 
-	data, err := base64.StdEncoding.DecodeString(line)
-	if err != nil {
-		return nil, err
-	}
-	buff := bytes.NewBuffer(data)
-	fileInfo = new(FileInformation)
-	fileInfo.Path = int32(readInt(buff, 4))
-	fileInfo.Error = readInt(buff, 1) != 0
-	fileInfo.Size = readInt(buff, 8)
-	frags := int(readInt(buff, 4))
-	fileInfo.Fragments = make([]sys.Fragment, frags)
-	for i := 0; i < frags; i++ {
-		logical := uint64(readInt(buff, 8))
-		start := uint64(readInt(buff, 8))
-		end := uint64(readInt(buff, 8))
-		fileInfo.Fragments[i] = sys.Fragment{logical, start, end}
+func (d *decoder) varint() int64 {
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(errors.New("invalid varint"))
+		return 0
 	}
+	d.data = d.data[n:]
+	return value
+}
 
-	return fileInfo, nil
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
 }
 
-func writeFileInfo(prefix string, fileInfo FileInformation, outfile *bufio.Writer) {
-	outfile.WriteString(prefix)
-	outfile.WriteByte(' ')
-	outfile.WriteString(serialize(fileInfo))
-	outfile.WriteByte('\n')
+func (d *decoder) bytes(n int) []byte {
+	if len(d.data) < n {
+		d.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
 }
 
-func parseHash(s string) (hash [HashSize]byte, err error) {
-	bytes, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return
+// Returns the sort key for a number, which compares as raw bytes in numerical order
+func numberKey(value uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, value)
+	return key
+}
+
+func writeFileInfo(key []byte, fileInfo FileInformation, hashSize int, outfile *bufio.Writer) {
+	if err := writeRecord(outfile, key, serialize(fileInfo, hashSize)); err != nil {
+		log.Fatalf("Failed to write to temporary file: %v", err)
 	}
-	copy(hash[:], bytes)
-	return
 }
 
-// TODO using panic/recover for the whole parse stack would probably be more readable
-func partitionFile(fileName string, prefixIsHash bool, receiver func([]*FileInformation)) {
+// Reads the records from the file and passes each run of records with the same key to the receiver. If keyIsHash is
+// true, the key is the checksum of the files.
+func partitionFile(fileName string, keyIsHash bool, receiver func([]*FileInformation)) {
 	infile, err := os.Open(fileName)
 	if err != nil {
-		log.Fatal("Failed to open %s", fileName)
+		log.Fatalf("Failed to open %s", fileName)
 	}
 	defer infile.Close()
-	scanner := bufio.NewScanner(infile)
-	scanner.Buffer(make([]byte, 4096), 10*1024*1024)
-	lastPrefix := ""
+	if err := readPartitions(bufio.NewReader(infile), keyIsHash, receiver); err != nil {
+		log.Fatalf("Failed to read %s, %v", fileName, err)
+	}
+}
+
+// Like partitionFile, but reads the records from the reader and returns an error if they can not be read
+func readPartitions(reader *bufio.Reader, keyIsHash bool, receiver func([]*FileInformation)) error {
+	var lastKey []byte
 	files := make([]*FileInformation, 0)
-	for scanner.Scan() {
-		line := scanner.Text()
-		idx := strings.Index(line, " ")
-		prefix := line[:idx]
-		fileInfo, err := deserialize(line[idx + 1:])
+	for {
+		key, payload, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Fatalf("Failed to parse %s, %v", line, err)
+			return err
 		}
-		if prefixIsHash {
-			fileInfo.Csum, err = parseHash(prefix)
-			if err != nil {
-				log.Fatalf("Failed to parse %s, %v", line, err)
-			}
+		fileInfo, err := deserialize(payload)
+		if err != nil {
+			return err
 		}
-		if prefix != lastPrefix {
+		if keyIsHash {
+			copy(fileInfo.Csum[:], key)
+		}
+		if !bytes.Equal(key, lastKey) {
 			if len(files) != 0 {
 				receiver(files)
 			}
-			files = files[0:0]
-			lastPrefix = prefix
+			files = make([]*FileInformation, 0)
+			lastKey = key
 		}
 		files = append(files, fileInfo)
 	}
-	if err:=scanner.Err(); err != nil {
-		log.Fatalf("Failed to parse %s, %v", fileName, err)
-	}
 	if len(files) != 0 {
 		receiver(files)
 	}
+	return nil
 }
 
-func sortFile(file string) {
-	log.Printf("Sorting %s", file)
-	command := exec.Command("sort", file, "-o", file)
-	err := command.Run()
-	if err != nil {
-		log.Fatal("Failed to sort %s", file)
+func sortStateFile(state *FileBased) {
+	if err := sortFile(state.infilename, state.options); err != nil {
+		log.Fatalf("Failed to sort %s: %v", state.infilename, err)
 	}
-	log.Printf("Sorted %s", file)
 }
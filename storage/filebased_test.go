@@ -1,13 +1,14 @@
 package storage
 
 import (
-	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 	"github.com/bertbaron/btrdedup/sys"
 )
 
 func equalsInfo(a, b FileInformation) bool {
-	equal := a.Path == b.Path && a.Error == b.Error && len(a.Fragments) == len(b.Fragments) && a.Csum == b.Csum
+	equal := a.Path == b.Path && a.Error == b.Error && a.Size == b.Size && a.EqualSize == b.EqualSize && len(a.Fragments) == len(b.Fragments) && a.Csum == b.Csum && a.HasCsum == b.HasCsum
 	if equal {
 		for i, frag := range a.Fragments {
 			equal = equal && frag == b.Fragments[i]
@@ -20,11 +21,16 @@ func TestSerialization(t *testing.T) {
 	var in FileInformation
 	in.Path = 123
 	in.Error = true
-	in.Fragments = []sys.Fragment{sys.Fragment{12345, 123}}
-	in.Csum = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	in.Size = 8192
+	in.EqualSize = 4096
+	in.Fragments = []sys.Fragment{sys.Fragment{Logical: 0, Start: 12345, Length: 123}}
+	in.Csum = [MaxHashSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 
-	data := serialize(in)
-	fmt.Printf("data size: %d (%v)\n", len(data), data)
+	data := serialize(in, 16)
+	// varints for the numbers and the fragment deltas, no checksum because HasCsum is false
+	if len(data) != 15 {
+		t.Errorf("Expected 15 bytes, but was %d (%v)", len(data), data)
+	}
 
 	out, err := deserialize(data)
 	if err != nil {
@@ -38,3 +44,99 @@ func TestSerialization(t *testing.T) {
 		t.Errorf("Exepected: %+v, but was: %+v", in, out)
 	}
 }
+
+func TestSerializationOfFragments(t *testing.T) {
+	var in FileInformation
+	in.Path = 7
+	in.Size = 3 * 4096
+	// fragments may be stored before each other on disk, so the deltas can be negative
+	in.Fragments = []sys.Fragment{
+		{Logical: 0, Start: 1 << 40, Length: 4096},
+		{Logical: 4096, Start: 4096, Length: 4096},
+		{Logical: 8192, Start: 1<<40 + 4096, Length: 4096},
+	}
+
+	out, err := deserialize(serialize(in, 16))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !equalsInfo(in, *out) {
+		t.Errorf("Exepected: %+v, but was: %+v", in, out)
+	}
+}
+
+func TestDeserializeTruncated(t *testing.T) {
+	var in FileInformation
+	in.Size = 4096
+	in.Fragments = []sys.Fragment{{Logical: 0, Start: 12345, Length: 4096}}
+	data := serialize(in, 16)
+	if _, err := deserialize(data[:len(data)-1]); err == nil {
+		t.Error("Expected an error for truncated data")
+	}
+}
+
+func TestSerializationWithChecksum(t *testing.T) {
+	var in FileInformation
+	in.Path = 123
+	in.Size = 4096
+	in.Fragments = []sys.Fragment{sys.Fragment{Logical: 0, Start: 12345, Length: 4096}}
+	in.Csum = [MaxHashSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	in.HasCsum = true
+
+	out, err := deserialize(serialize(in, 16))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !equalsInfo(in, *out) {
+		t.Errorf("Exepected: %+v, but was: %+v", in, out)
+	}
+}
+
+func TestCloseRemovesTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := NewFileBased(16, SortOptions{TempDir: dir})
+	state.StartPass1()
+	state.AddFile(FileInformation{Path: 1, Size: 4096})
+	state.EndPass1()
+	// interrupted during pass 2
+	state.StartPass2()
+	state.Close()
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the temporary files to be removed, but found %d files", len(files))
+	}
+}
+
+func TestScanOnOffsetWritesNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := NewFileBased(16, SortOptions{TempDir: dir})
+	defer state.Close()
+	state.StartPass1()
+	state.AddFile(FileInformation{Path: 1, Size: 4096})
+	state.AddFile(FileInformation{Path: 2, Size: 4096})
+	state.EndPass1()
+	before, _ := ioutil.ReadDir(dir)
+
+	for scan := 0; scan < 2; scan++ {
+		count := 0
+		state.ScanOnOffset(func(files []*FileInformation) {
+			count += len(files)
+		})
+		if count != 2 {
+			t.Errorf("Expected both files in scan %d, but was %d", scan, count)
+		}
+	}
+	if after, _ := ioutil.ReadDir(dir); len(after) != len(before) {
+		t.Errorf("Expected no new temporary files, but found %d instead of %d", len(after), len(before))
+	}
+}
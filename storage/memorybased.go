@@ -2,10 +2,13 @@ package storage
 
 import (
 	"sort"
+	"sync"
 )
 
 type MemoryBased struct {
-	files []*FileInformation
+	lock   sync.Mutex
+	files  []*FileInformation
+	groups [][]*FileInformation
 }
 
 type ByOffset []*FileInformation
@@ -50,6 +53,8 @@ func NewMemoryBased() *MemoryBased {
 func (state *MemoryBased) StartPass1() {}
 
 func (state *MemoryBased) AddFile(file FileInformation) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
 	state.files = append(state.files, &file)
 }
 
@@ -61,16 +66,18 @@ func (state *MemoryBased) EndPass1() {
 
 func (state *MemoryBased) StartPass2() {}
 
-func (state *MemoryBased) PartitionOnOffset(receiver func(files []*FileInformation) bool) {
-	lastOffset := uint64(0)
+func (state *MemoryBased) PartitionOnOffset(jobs int, receiver func(files []*FileInformation) bool) {
+	w := newWindow(jobs, receiver, func(files []*FileInformation, ok bool) {})
+	state.ScanOnOffset(w.add)
+	w.flush()
+}
+
+func (state *MemoryBased) ScanOnOffset(receiver func(files []*FileInformation)) {
 	var partition []*FileInformation
 	for _, file := range state.files {
-		if file.PhysicalOffset() != lastOffset {
-			if len(partition) != 0 {
-				receiver(partition)
-			}
+		if len(partition) != 0 && !sameFirstBlock(partition[0], file) {
+			receiver(partition)
 			partition = partition[0:0]
-			lastOffset = file.PhysicalOffset()
 		}
 		partition = append(partition, file)
 	}
@@ -87,26 +94,44 @@ func (state *MemoryBased) EndPass2() {
 
 func (state *MemoryBased) StartPass3() {}
 
-func (state *MemoryBased) PartitionOnHash(receiver func(files []*FileInformation)) {
-	var lastHash [16]byte
+func (state *MemoryBased) PartitionOnHash(receiver func(files []*FileInformation) [][]*FileInformation) {
+	var lastHash [MaxHashSize]byte
 	var partition []*FileInformation
 	for _, file := range state.files {
 		if !file.Error {
 			if file.Csum != lastHash {
 				if len(partition) != 0 {
-					receiver(partition)
+					state.groups = append(state.groups, receiver(partition)...)
 				}
-				partition = partition[0:0]
+				partition = make([]*FileInformation, 0)
 				lastHash = file.Csum
 			}
 			partition = append(partition, file)
 		}
 	}
 	if len(partition) != 0 {
-		receiver(partition)
+		state.groups = append(state.groups, receiver(partition)...)
 	}
 }
 
-func (state *MemoryBased) EndPass3() {}
+func (state *MemoryBased) EndPass3() {
+	state.files = nil
+}
+
+// ** PASS 4 **
+
+func (state *MemoryBased) StartPass4() {}
+
+func (state *MemoryBased) PartitionOnContent(receiver func(files []*FileInformation)) {
+	for _, group := range state.groups {
+		receiver(group)
+	}
+}
+
+func (state *MemoryBased) EndPass4() {}
+
+func (state *MemoryBased) Close() {
+	state.files, state.groups = nil, nil
+}
 
 // ** private functions **
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lastSuccessMetric = "btrdedup_last_success_timestamp_seconds"
+
+// Writes the statistics to a file in the text format that is read by the textfile collector of node_exporter. The file
+// is written periodically during the run and once more when the run ends.
+type MetricsExporter struct {
+	name  string
+	stats *Statistics
+	// unix time of the last successful run, 0 if unknown
+	lastSuccess float64
+	stop        chan bool
+	done        chan bool
+}
+
+// Starts writing the metrics of the statistics to the file with the given name every interval
+func NewMetricsExporter(name string, stats *Statistics, interval time.Duration) *MetricsExporter {
+	m := &MetricsExporter{name: name, stats: stats, lastSuccess: readLastSuccess(name), stop: make(chan bool), done: make(chan bool)}
+	go m.run(interval)
+	return m
+}
+
+func (m *MetricsExporter) run(interval time.Duration) {
+	defer close(m.done)
+	m.write(true)
+	if interval <= 0 {
+		<-m.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.write(true)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Stops the periodic writes and writes the final metrics. The time of the last success is updated if the run
+// succeeded. Must be called before the statistics are stopped.
+func (m *MetricsExporter) Stop(success bool) {
+	close(m.stop)
+	<-m.done
+	if success {
+		m.lastSuccess = float64(time.Now().Unix())
+	}
+	m.write(false)
+}
+
+func (m *MetricsExporter) write(running bool) {
+	c := make(chan metricsSnapshot)
+	m.stats.channel <- func(s *Statistics) {
+		c <- metricsSnapshot{s.snapshot(), s.pass}
+	}
+	snapshot := <-c
+	if err := WriteAtomically(m.name, snapshot.format(running, m.lastSuccess), 0644); err != nil {
+		log.Printf("Unable to write metrics: %v", err)
+	}
+}
+
+type metricsSnapshot struct {
+	report Report
+	pass   int
+}
+
+func (s metricsSnapshot) format(running bool, lastSuccess float64) []byte {
+	var b bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	value := func(name string, value interface{}) {
+		fmt.Fprintf(&b, "%s %v\n", name, value)
+	}
+	r := s.report
+
+	metric("btrdedup_running", "gauge", "Whether a run is in progress")
+	value("btrdedup_running", boolValue(running))
+	metric("btrdedup_current_pass", "gauge", "The pass that is in progress, 0 before the first pass")
+	value("btrdedup_current_pass", s.pass)
+	metric("btrdedup_run_start_timestamp_seconds", "gauge", "Start time of the run")
+	value("btrdedup_run_start_timestamp_seconds", r.Start.Unix())
+	metric("btrdedup_run_duration_seconds", "gauge", "Duration of the run so far")
+	value("btrdedup_run_duration_seconds", r.End.Sub(r.Start).Seconds())
+	if lastSuccess > 0 {
+		metric(lastSuccessMetric, "gauge", "End time of the last successful run")
+		value(lastSuccessMetric, strconv.FormatFloat(lastSuccess, 'f', -1, 64))
+	}
+
+	metric("btrdedup_files_collected_total", "counter", "Files collected for scanning")
+	value("btrdedup_files_collected_total", r.Collected)
+	metric("btrdedup_files_scanned_total", "counter", "Files of which the fragmentation information is read")
+	value("btrdedup_files_scanned_total", r.Scanned)
+	metric("btrdedup_files_skipped_total", "counter", "Files that are skipped, by reason")
+	var reasons []string
+	for reason := range r.Skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		value(fmt.Sprintf("btrdedup_files_skipped_total{reason=%q}", reason), r.Skipped[reason])
+	}
+	metric("btrdedup_hashes_calculated_total", "counter", "Files for which the hash of the first block is known")
+	value("btrdedup_hashes_calculated_total", r.Hashed)
+	metric("btrdedup_candidate_groups_total", "counter", "Groups of files with equal content")
+	value("btrdedup_candidate_groups_total", r.CandidateGroups)
+	metric("btrdedup_groups_deduplicated_total", "counter", "Groups of which unshared data is offered for deduplication")
+	value("btrdedup_groups_deduplicated_total", r.GroupsOffered)
+	metric("btrdedup_bytes_already_shared_total", "counter", "Bytes in candidate files that were already shared")
+	value("btrdedup_bytes_already_shared_total", r.BytesShared)
+	metric("btrdedup_bytes_offered_total", "counter", "Bytes offered for deduplication")
+	value("btrdedup_bytes_offered_total", r.BytesOffered)
+	metric("btrdedup_bytes_deduplicated_total", "counter", "Bytes deduplicated according to the kernel")
+	value("btrdedup_bytes_deduplicated_total", r.BytesDeduped)
+	metric("btrdedup_data_differs_total", "counter", "Destinations for which the kernel reported that the data differs")
+	value("btrdedup_data_differs_total", r.DataDiffers)
+	metric("btrdedup_errors_total", "counter", "Files that could not be scanned and failed deduplication requests")
+	value("btrdedup_errors_total", r.Skipped[SkippedError]+r.DedupErrors)
+	defragmented := 0
+	for _, action := range r.Defrag {
+		if action.Result == DefragDone {
+			defragmented++
+		}
+	}
+	metric("btrdedup_files_defragmented_total", "counter", "Files that are defragmented")
+	value("btrdedup_files_defragmented_total", defragmented)
+	return b.Bytes()
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returns the time of the last successful run from a previously written metrics file, 0 if unknown
+func readLastSuccess(name string) float64 {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == lastSuccessMetric {
+			if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				return value
+			}
+		}
+	}
+	return 0
+}
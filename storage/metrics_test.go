@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "btrdedup.prom")
+	if err := ioutil.WriteFile(name, []byte(lastSuccessMetric+" 1234\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := NewProgressLogStats()
+	stats.Start()
+	defer stats.Stop()
+	metrics := NewMetricsExporter(name, stats, 0)
+	stats.FileSkipped(SkippedTooSmall)
+	stats.Offered(8192, 0)
+	stats.Deduplicated(4096, 1, 0)
+	metrics.Stop(false)
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"btrdedup_running 0\n",
+		lastSuccessMetric + " 1234\n",
+		`btrdedup_files_skipped_total{reason="too_small"} 1` + "\n",
+		"btrdedup_groups_deduplicated_total 1\n",
+		"btrdedup_bytes_deduplicated_total 4096\n",
+		"btrdedup_data_differs_total 1\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %q in metrics:\n%s", expected, data)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the metrics file, but was %d files", len(files))
+	}
+}
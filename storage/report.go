@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+// Reasons for which files are skipped
+const (
+	SkippedExcluded        = "excluded"
+	SkippedTooSmall        = "too_small"
+	SkippedHardLink        = "hard_link"
+	SkippedOtherFilesystem = "other_filesystem"
+	SkippedUnallocated     = "unallocated"
+	SkippedError           = "error"
+)
+
+// Results of a defragmentation
+const (
+	DefragDone        = "defragmented"
+	DefragFailed      = "failed"
+	DefragNotWritable = "not_writable"
+	DefragNoact       = "noact"
+	DefragSkipped     = "skipped"
+	DefragNoSpace     = "no_space"
+)
+
+// Machine-readable summary of a run
+type Report struct {
+	Version string    `json:"version"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Noact   bool      `json:"noact"`
+	// true if the run is interrupted by a signal, the report contains the statistics up to the interruption
+	Interrupted bool `json:"interrupted"`
+	Collected   int  `json:"files_collected"`
+	// files of which the fragmentation information has been read or taken from the cache
+	Scanned int            `json:"files_scanned"`
+	Skipped map[string]int `json:"files_skipped"`
+	// files for which the hash of the first block is known
+	Hashed int `json:"hashes_calculated"`
+	// groups of files with equal content that have been considered for deduplication
+	CandidateGroups int `json:"candidate_groups"`
+	CandidateFiles  int `json:"candidate_files"`
+	// bytes in the candidate files that already share their data with the first file of the group
+	BytesShared int64 `json:"bytes_already_shared"`
+	// groups of which unshared data has been offered for deduplication
+	GroupsOffered int   `json:"groups_offered"`
+	BytesOffered  int64 `json:"bytes_offered"`
+	// offered bytes that are stored in compressed extents
+	BytesCompressed int64 `json:"bytes_offered_compressed"`
+	// bytes deduplicated according to the kernel, summed over the destinations
+	BytesDeduped int64 `json:"bytes_deduped"`
+	// number of destinations for which the kernel reported that the data differs
+	DataDiffers int            `json:"data_differs"`
+	DedupErrors int            `json:"dedup_errors"`
+	Defrag      []DefragAction `json:"defragmentation"`
+	Passes      []PassTiming   `json:"passes"`
+}
+
+type DefragAction struct {
+	Path            string   `json:"path"`
+	FragmentsBefore int      `json:"fragments_before"`
+	FragmentsAfter  int      `json:"fragments_after,omitempty"`
+	Result          string   `json:"result"`
+	Reason          string   `json:"reason,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	Copies          int      `json:"copies,omitempty"`    // copies relinked to the defragmented file in the defrag mode
+	Blocking        []string `json:"blocking,omitempty"`  // copies that prevent the defragmentation because they can't be relinked
+	Overrides       string   `json:"overrides,omitempty"` // the source chosen by the source policy, replaced by the defragmented file
+}
+
+type PassTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Writes the report as JSON to the file with the given name
+func (r *Report) Write(name string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding report failed")
+	}
+	return WriteAtomically(name, append(data, '\n'), 0644)
+}
+
+// Prints a summary of the report
+func (r *Report) Print(w io.Writer) {
+	skipped := 0
+	for _, count := range r.Skipped {
+		skipped += count
+	}
+	fmt.Fprintf(w, "Files: %d collected, %d scanned, %d skipped\n", r.Collected, r.Scanned, skipped)
+	fmt.Fprintf(w, "Groups: %d candidates with %d files, %d offered for deduplication\n", r.CandidateGroups, r.CandidateFiles, r.GroupsOffered)
+	fmt.Fprintf(w, "Bytes: %d already shared, %d offered, %d deduplicated\n", r.BytesShared, r.BytesOffered, r.BytesDeduped)
+	if r.DataDiffers > 0 || r.DedupErrors > 0 {
+		fmt.Fprintf(w, "Deduplication: data differed %d times, %d errors\n", r.DataDiffers, r.DedupErrors)
+	}
+	if len(r.Defrag) > 0 {
+		results := make(map[string]int)
+		for _, action := range r.Defrag {
+			results[action.Result]++
+		}
+		fmt.Fprintf(w, "Defragmentation: %d defragmented, %d failed, %d skipped for lack of free space\n", results[DefragDone], results[DefragFailed], results[DefragNoSpace])
+	}
+	fmt.Fprintf(w, "Duration: %s\n", r.End.Sub(r.Start).Round(time.Second))
+}
+
+func (s *Statistics) FileSkipped(reason string) {
+	s.channel <- func(s *Statistics) {
+		s.report.Skipped[reason]++
+	}
+}
+
+func (s *Statistics) Candidate(files int, shared int64) {
+	s.channel <- func(s *Statistics) {
+		s.report.CandidateGroups++
+		s.report.CandidateFiles += files
+		s.report.BytesShared += shared
+	}
+}
+
+func (s *Statistics) Offered(bytes, compressed int64) {
+	s.channel <- func(s *Statistics) {
+		s.report.GroupsOffered++
+		s.report.BytesOffered += bytes
+		s.report.BytesCompressed += compressed
+	}
+}
+
+func (s *Statistics) Deduplicated(bytes int64, dataDiffers, errors int) {
+	s.channel <- func(s *Statistics) {
+		s.report.BytesDeduped += bytes
+		s.report.DataDiffers += dataDiffers
+		s.report.DedupErrors += errors
+	}
+}
+
+func (s *Statistics) Defragmented(action DefragAction) {
+	s.channel <- func(s *Statistics) {
+		s.report.Defrag = append(s.report.Defrag, action)
+	}
+}
+
+// Returns a copy of the report of the run so far
+func (s *Statistics) Report() Report {
+	c := make(chan Report)
+	s.channel <- func(s *Statistics) {
+		c <- s.snapshot()
+	}
+	return <-c
+}
+
+// Returns a copy of the report, must be called from the statistics goroutine
+func (s *Statistics) snapshot() Report {
+	report := s.report
+	report.Skipped = make(map[string]int, len(s.report.Skipped))
+	for reason, count := range s.report.Skipped {
+		report.Skipped[reason] = count
+	}
+	report.Defrag = append([]DefragAction(nil), s.report.Defrag...)
+	report.Passes = append([]PassTiming(nil), s.report.Passes...)
+	report.Collected = s.fileCount
+	report.Scanned = s.filesFound
+	report.Hashed = s.hashTot
+	report.End = time.Now()
+	return report
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// default memory budget for sorting
+	DefaultSortMemory int64 = 64 * 1024 * 1024
+	// estimated memory overhead per record in addition to its data
+	recordOverhead = 32
+	// maximum number of runs that are merged at once, to limit the number of open files
+	maxMergeFanIn = 64
+)
+
+// Options for the external merge sort that is used in low memory mode
+type SortOptions struct {
+	// maximum number of bytes used for the records in memory, divided over the chunk that is being read and the chunks
+	// that are being sorted
+	Memory int64
+	// directory for the temporary files, the default temporary directory is used if empty
+	TempDir string
+	// number of runs that are generated concurrently
+	Jobs int
+}
+
+// Records consist of a key and a payload. They are written as the length of the record followed by the length of the
+// key, the key and the payload. The lengths are written as uvarints, so records can have any size. Records are sorted
+// on their key, which is compared as raw bytes.
+
+// Writes a record with the given key and payload
+func writeRecord(writer *bufio.Writer, key, payload []byte) error {
+	var header [binary.MaxVarintLen64]byte
+	keyHeader := binary.PutUvarint(header[:], uint64(len(key)))
+	record := make([]byte, 0, keyHeader+len(key)+len(payload))
+	record = append(record, header[:keyHeader]...)
+	record = append(record, key...)
+	record = append(record, payload...)
+	return writeRawRecord(writer, record)
+}
+
+// Reads a record and returns its key and payload, returns io.EOF if there are no more records
+func readRecord(reader *bufio.Reader) ([]byte, []byte, error) {
+	record, err := readRawRecord(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyLength, n := binary.Uvarint(record)
+	if n <= 0 || keyLength > uint64(len(record)-n) {
+		return nil, nil, errors.New("invalid record key")
+	}
+	return record[n : n+int(keyLength)], record[n+int(keyLength):], nil
+}
+
+// Reads a record without its length, returns io.EOF if there are no more records
+func readRawRecord(reader *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(reader, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+func writeRawRecord(writer *bufio.Writer, record []byte) error {
+	var header [binary.MaxVarintLen64]byte
+	if _, err := writer.Write(header[:binary.PutUvarint(header[:], uint64(len(record)))]); err != nil {
+		return err
+	}
+	_, err := writer.Write(record)
+	return err
+}
+
+func recordKey(record []byte) []byte {
+	keyLength, n := binary.Uvarint(record)
+	if n <= 0 || keyLength > uint64(len(record)-n) {
+		return record
+	}
+	return record[n : n+int(keyLength)]
+}
+
+// Compares records on their key. Records with equal keys are compared on their payload, so the order is
+// deterministic.
+func lessRecord(a, b []byte) bool {
+	if c := bytes.Compare(recordKey(a), recordKey(b)); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// Sorts the records in the file in place. Chunks of records that fit in memory are sorted concurrently into temporary
+// run files, which are then merged.
+func sortFile(name string, options SortOptions) error {
+	log.Printf("Sorting %s", name)
+	runs, err := createRuns(name, options)
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for len(runs) > maxMergeFanIn {
+		merged, err := mergeToTempFile(runs[:maxMergeFanIn], options.TempDir)
+		for _, run := range runs[:maxMergeFanIn] {
+			os.Remove(run)
+		}
+		runs = append(runs[maxMergeFanIn:], merged...)
+		if err != nil {
+			return err
+		}
+	}
+	if err := mergeRuns(runs, name); err != nil {
+		return err
+	}
+	log.Printf("Sorted %s", name)
+	return nil
+}
+
+// Splits the file in sorted runs, returns the names of the run files. The names of the runs that are already created
+// are returned on failure as well, so they can be removed.
+func createRuns(name string, options SortOptions) ([]string, error) {
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	memory := options.Memory
+	if memory <= 0 {
+		memory = DefaultSortMemory
+	}
+	chunkMemory := memory / int64(jobs+1)
+
+	infile, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file for sorting failed")
+	}
+	defer infile.Close()
+	reader := bufio.NewReader(infile)
+
+	var lock sync.Mutex
+	var runs []string
+	var runErr error
+	var wg sync.WaitGroup
+	slots := make(chan bool, jobs)
+	writeRun := func(records [][]byte) {
+		defer func() {
+			wg.Done()
+			<-slots
+		}()
+		sort.Slice(records, func(i, j int) bool {
+			return lessRecord(records[i], records[j])
+		})
+		run, err := writeTempFile(records, options.TempDir)
+		lock.Lock()
+		defer lock.Unlock()
+		if run != "" {
+			runs = append(runs, run)
+		}
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+
+	var records [][]byte
+	var used int64
+	chunks := 0
+	for {
+		record, err := readRawRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return runs, errors.Wrapf(err, "reading %s failed", name)
+		}
+		records = append(records, record)
+		used += int64(len(record)) + recordOverhead
+		if used >= chunkMemory {
+			slots <- true
+			wg.Add(1)
+			go writeRun(records)
+			records, used = nil, 0
+			chunks++
+		}
+	}
+	// an empty file results in one empty run
+	if len(records) > 0 || chunks == 0 {
+		slots <- true
+		wg.Add(1)
+		go writeRun(records)
+	}
+	wg.Wait()
+	return runs, runErr
+}
+
+func writeTempFile(records [][]byte, dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, "btrdedup-run")
+	if err != nil {
+		return "", errors.Wrap(err, "create run file failed")
+	}
+	writer := bufio.NewWriter(f)
+	for _, record := range records {
+		if err = writeRawRecord(writer, record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return f.Name(), errors.Wrap(err, "writing run file failed")
+}
+
+func mergeToTempFile(runs []string, dir string) ([]string, error) {
+	f, err := ioutil.TempFile(dir, "btrdedup-run")
+	if err != nil {
+		return nil, errors.Wrap(err, "create run file failed")
+	}
+	f.Close()
+	return []string{f.Name()}, mergeRuns(runs, f.Name())
+}
+
+// A run that is being merged, with its next record
+type runReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	record []byte
+}
+
+type runHeap struct {
+	readers []*runReader
+}
+
+func (h *runHeap) Len() int           { return len(h.readers) }
+func (h *runHeap) Less(i, j int) bool { return lessRecord(h.readers[i].record, h.readers[j].record) }
+func (h *runHeap) Swap(i, j int)      { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runHeap) Push(x interface{}) { h.readers = append(h.readers, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
+
+// Merges the sorted runs into the file with the given name. The file is replaced atomically, so it can be one of the
+// runs.
+func mergeRuns(runs []string, name string) error {
+	h := &runHeap{}
+	defer func() {
+		for _, r := range h.readers {
+			r.file.Close()
+		}
+	}()
+	for _, run := range runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return errors.Wrap(err, "open run file failed")
+		}
+		r := &runReader{file: f, reader: bufio.NewReader(f)}
+		if r.record, err = readRawRecord(r.reader); err == io.EOF {
+			f.Close()
+			continue
+		} else if err != nil {
+			f.Close()
+			return errors.Wrapf(err, "reading %s failed", run)
+		}
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+
+	out, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".merge")
+	if err != nil {
+		return errors.Wrap(err, "create merge file failed")
+	}
+	writer := bufio.NewWriter(out)
+	for err == nil && h.Len() > 0 {
+		r := h.readers[0]
+		if err = writeRawRecord(writer, r.record); err != nil {
+			break
+		}
+		if r.record, err = readRawRecord(r.reader); err == io.EOF {
+			err = nil
+			r.file.Close()
+			heap.Pop(h)
+		} else if err == nil {
+			heap.Fix(h, 0)
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), name)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return errors.Wrapf(err, "merging into %s failed", name)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSortFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "data")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := bufio.NewWriter(f)
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%x", (i*7919)%1000)
+		keys = append(keys, key)
+		// the payload of some records is larger than the memory budget
+		payload := strings.Repeat("x", i%3*1000)
+		if err := writeRecord(writer, []byte(key), []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Flush()
+	f.Close()
+
+	// a small memory budget results in many runs, which requires multiple merge levels
+	options := SortOptions{Memory: 1000, TempDir: dir, Jobs: 3}
+	if err := sortFile(name, options); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	sort.Strings(keys)
+	for i, expected := range keys {
+		key, _, err := readRecord(reader)
+		if err != nil {
+			t.Fatalf("Unexpected error reading record %d: %v", i, err)
+		}
+		if string(key) != expected {
+			t.Fatalf("Expected key %s at position %d, but was %s", expected, i, key)
+		}
+	}
+	if _, _, err := readRecord(reader); err != io.EOF {
+		t.Errorf("Expected end of file, but was %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the temporary runs to be removed, but found %d files", len(files))
+	}
+}
@@ -48,20 +48,29 @@ type Statistics struct {
 	fileCount  int
 	filesFound int
 	hashTot    int
+	groupedTot int
 
 	showPb     bool
 	progress   progressBar
 	passName   string
+	// number of the pass that is in progress, 0 before the first pass
+	pass       int
 	start      time.Time
 	channel    chan func(*Statistics)
+	report     Report
+}
+
+func newStatistics(showPb bool) *Statistics {
+	report := Report{Start: time.Now(), Skipped: make(map[string]int)}
+	return &Statistics{showPb: showPb, channel: make(chan func(*Statistics), 10), report: report}
 }
 
 func NewProgressBarStats() *Statistics {
-	return &Statistics{showPb: true, channel: make(chan func(*Statistics), 10)}
+	return newStatistics(true)
 }
 
 func NewProgressLogStats() *Statistics {
-	return &Statistics{showPb: false, channel: make(chan func(*Statistics), 10)}
+	return newStatistics(false)
 }
 
 func process(s *Statistics) {
@@ -87,6 +96,7 @@ func (s *Statistics) Stop() {
 
 func (s *Statistics) startProgress(name string, count int) {
 	s.passName = name
+	s.pass++
 	s.start = time.Now()
 	s.progress = newLogProgressBar(count)
 	if s.showPb {
@@ -103,6 +113,7 @@ func (s *Statistics) StopProgress() {
 		duration := time.Since(s.start)
 		s.progress.Finish()
 		log.Printf("Pass %s completed in %s", s.passName, duration)
+		s.report.Passes = append(s.report.Passes, PassTiming{s.passName, duration.Seconds()})
 	}
 }
 
@@ -137,21 +148,46 @@ func (s *Statistics) HashesCalculated(count int) {
 	}
 }
 
+func (s *Statistics) ContentVerified(count int, grouped int) {
+	s.channel <- func(s *Statistics) {
+		s.groupedTot += grouped
+		s.updateProgress(count)
+	}
+}
+
 func (s *Statistics) Deduplicating(count int) {
 	s.channel <- func(s *Statistics) {
 		s.updateProgress(count)
 	}
 }
 
+func (s *Statistics) Defragmenting(count int) {
+	s.channel <- func(s *Statistics) {
+		s.updateProgress(count)
+	}
+}
+
 func (s *Statistics) StartHashProgress() {
 	s.channel <- func(s *Statistics) {
 		s.startProgress("Calculating hashes for first block of each file", s.filesFound)
 	}
 }
 
+func (s *Statistics) StartVerifyProgress() {
+	s.channel <- func(s *Statistics) {
+		s.startProgress("Verifying the content of files with equal first block", s.hashTot)
+	}
+}
+
 func (s *Statistics) StartDedupProgress() {
 	s.channel <- func(s *Statistics) {
-		s.startProgress("Deduplication", s.hashTot)
+		s.startProgress("Deduplication", s.groupedTot)
+	}
+}
+
+func (s *Statistics) StartDefragProgress(count int) {
+	s.channel <- func(s *Statistics) {
+		s.startProgress("Defragmentation", count)
 	}
 }
 
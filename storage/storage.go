@@ -5,11 +5,11 @@ import (
 	"path/filepath"
 	"sync"
 	"golang.org/x/sys/unix"
-	"log"
 )
 
 const (
-	HashSize = 16
+	// maximum size of the checksums in bytes, smaller checksums are padded with zeros
+	MaxHashSize = 32
 )
 
 type FileInformation struct {
@@ -17,29 +17,104 @@ type FileInformation struct {
 	Path      int32
 	Error     bool
 	Size	  int64
+	// Number of bytes for which the content is verified to be equal to the other files in its group, set in pass 3
+	EqualSize int64
 	Fragments []sys.Fragment
-	Csum      [HashSize]byte
+	Csum      [MaxHashSize]byte
+	// True if Csum is already known before pass 2, i.e. from the scan cache
+	HasCsum   bool
 }
 
+// The physical location of the data from a logical offset in a file
+type Extent struct {
+	// physical offset of the data, 0 for a hole
+	Start  uint64
+	// number of bytes from the logical offset that are stored contiguously, or the length of the hole
+	Length uint64
+	Hole   bool
+	// the fragment that contains the data, only the flags are relevant
+	Fragment sys.Fragment
+}
+
+// Returns true if the data reads back as zeros without being stored
+func (e Extent) Zero() bool {
+	return e.Hole || e.Fragment.Unwritten()
+}
+
+// Returns true if the physical offset identifies the data
+func (e Extent) Located() bool {
+	return !e.Hole && e.Fragment.Located()
+}
+
+// Returns true if the data of both extents is known to be equal without reading it, because they are physically
+// shared or both zero
+func (e Extent) SameData(other Extent) bool {
+	return e.Zero() && other.Zero() || e.Located() && other.Located() && e.Start == other.Start
+}
+
+// Returns the physical offset of the first block, or 0 if the first block is zero or has no location, like inline data
 func (f *FileInformation) PhysicalOffset() uint64 {
-	return f.Fragments[0].Start
+	first := f.PhysicalExtentAt(0)
+	if first.Zero() || !first.Located() {
+		return 0
+	}
+	return first.Start
+}
+
+// Returns true if the first block is known to be equal to the first block of other files with the same physical
+// offset
+func (f *FileInformation) FirstBlockShareable() bool {
+	first := f.PhysicalExtentAt(0)
+	return first.Zero() || first.Located()
 }
 
+// Returns true if the files are known to have the same first block without reading it
+func sameFirstBlock(a, b *FileInformation) bool {
+	return a.PhysicalOffset() == b.PhysicalOffset() && a.FirstBlockShareable() && b.FirstBlockShareable()
+}
+
+// Returns the physical offset at logical offset i, or 0 if i is in a hole.
 // Pre: 0 <= i < file size
 func (information *FileInformation) PhysicalOffsetAt(i int64) uint64 {
-	remaining := uint64(i)
-	for _, frag := range information.Fragments {
-		if remaining < frag.Length {
-			return frag.Start + remaining
+	return information.PhysicalExtentAt(i).Start
+}
+
+// Returns the physical extent at logical offset i. Returns an empty extent if i is beyond the size and the fragments
+// of the file.
+func (information *FileInformation) PhysicalExtentAt(i int64) Extent {
+	cursor := ExtentCursor{file: information}
+	return cursor.At(i)
+}
+
+// Finds the physical extents of a file at increasing logical offsets, without searching the fragments from the start
+// for each offset
+type ExtentCursor struct {
+	file  *FileInformation
+	index int
+}
+
+func NewExtentCursor(file *FileInformation) *ExtentCursor {
+	return &ExtentCursor{file: file}
+}
+
+// Like PhysicalExtentAt. Pre: i is not smaller than in the previous call
+func (c *ExtentCursor) At(i int64) Extent {
+	offset := uint64(i)
+	fragments := c.file.Fragments
+	for c.index < len(fragments) && fragments[c.index].Logical+fragments[c.index].Length <= offset {
+		c.index++
+	}
+	if c.index < len(fragments) {
+		frag := fragments[c.index]
+		if offset < frag.Logical {
+			return Extent{Length: frag.Logical - offset, Hole: true}
 		}
-		remaining = remaining - frag.Length
+		return Extent{Start: frag.Start + offset - frag.Logical, Length: frag.Logical + frag.Length - offset, Fragment: frag}
 	}
-	log.Printf("WARNING: Offset %d is beyond file fragments:")
-	log.Printf("DEBUG: size: %d, fragments: ", information.Size)
-	for idx, frag := range information.Fragments {
-		log.Printf("DEBUG:     %d, %d, %d", idx, frag.Start, frag.Length)
+	if i < c.file.Size {
+		return Extent{Length: uint64(c.file.Size - i), Hole: true}
 	}
-	return 0 // TODO Return an error?
+	return Extent{}
 }
 
 //func (f *FileInformation) Size() int64 {
@@ -55,20 +130,39 @@ func (f *FileInformation) Writable(pathstore PathStorage) bool {
 }
 
 type DedupInterface interface {
-	// phase 1, collect all file information grouped by their physical offset
+	// phase 1, collect all file information grouped by their physical offset. AddFile may be called concurrently
 	StartPass1()
 	AddFile(file FileInformation)
 	EndPass1() // sort here
 
-	// phase 2, updates the file information with checksums of the first block
+	// phase 2, updates the file information with checksums of the first block. The receiver is called concurrently by
+	// the given number of jobs
 	StartPass2()
-	PartitionOnOffset(receiver func(files []*FileInformation) bool)
+	PartitionOnOffset(jobs int, receiver func(files []*FileInformation) bool)
 	EndPass2() // sort here
 
-	// phase 3, deduplicates files if possible
+	// for the defrag mode, passes the files of pass 1 partitioned on their physical offset to the receiver without
+	// starting pass 2, so nothing is written. May be called more than once, the receiver must not keep the slice.
+	ScanOnOffset(receiver func(files []*FileInformation))
+
+	// phase 3, splits the files with equal checksums into groups of files with verified equal content. The receiver
+	// returns these groups, with EqualSize set for each file
 	StartPass3()
-	PartitionOnHash(receiver func(files []*FileInformation))
+	PartitionOnHash(receiver func(files []*FileInformation) [][]*FileInformation)
 	EndPass3()
+
+	// phase 4, deduplicates files if possible
+	StartPass4()
+	PartitionOnContent(receiver func(files []*FileInformation))
+	EndPass4()
+
+	// saves the state after pass 1, 2 or 3 to the file with the given name, so an interrupted run can be resumed
+	Save(name string, pass int) error
+	// restores the state saved after the given pass, after which the next pass can be started
+	Restore(name string, pass int) error
+
+	// releases the state and removes its temporary files, also when a pass is interrupted
+	Close()
 }
 
 // Stores pathnames in an efficient way. Directories and files are stored separately an can as such have the same
@@ -95,6 +189,9 @@ type PathStorage interface {
 	// Passes all the file names (not the dir names) to the consumer function.
 	// NOTE: During iteration no files or directories should be added
 	ProcessFiles(consumer func(filenr int32, filename string))
+
+	// Saves the paths to the file with the given name, they can be loaded again with LoadPathStorage
+	Save(name string) error
 }
 
 type pathnode struct {
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"github.com/bertbaron/btrdedup/sys"
+	"testing"
+)
+
+func TestPhysicalExtentAtWithHoles(t *testing.T) {
+	file := &FileInformation{Size: 100, Fragments: []sys.Fragment{
+		{Logical: 10, Start: 1000, Length: 20},
+		{Logical: 50, Start: 2000, Length: 10},
+	}}
+	tests := []struct {
+		offset        int64
+		start, length uint64
+	}{
+		{0, 0, 10},
+		{15, 1005, 15},
+		{30, 0, 20},
+		{55, 2005, 5},
+		{60, 0, 40},
+		{100, 0, 0},
+	}
+	cursor := NewExtentCursor(file)
+	for _, test := range tests {
+		if e := file.PhysicalExtentAt(test.offset); e.Start != test.start || e.Length != test.length {
+			t.Errorf("Expected %d, %d at offset %d, but was %d, %d", test.start, test.length, test.offset, e.Start, e.Length)
+		}
+		if e := cursor.At(test.offset); e.Start != test.start || e.Length != test.length {
+			t.Errorf("Expected %d, %d from cursor at offset %d, but was %d, %d", test.start, test.length, test.offset, e.Start, e.Length)
+		}
+	}
+	if offset := file.PhysicalOffset(); offset != 0 {
+		t.Errorf("Expected offset 0 for a file starting with a hole, but was %d", offset)
+	}
+}
+
+func TestSameData(t *testing.T) {
+	data := Extent{Start: 1000, Length: 10}
+	inline := Extent{Length: 10, Fragment: sys.Fragment{Flags: sys.FIEMAP_EXTENT_DATA_INLINE}}
+	encoded := Extent{Start: 1000, Length: 10, Fragment: sys.Fragment{Flags: sys.FIEMAP_EXTENT_ENCODED}}
+	unwritten := Extent{Start: 2000, Length: 10, Fragment: sys.Fragment{Flags: sys.FIEMAP_EXTENT_UNWRITTEN}}
+	hole := Extent{Length: 10, Hole: true}
+
+	if !data.SameData(data) {
+		t.Error("Expected extents at the same location to have the same data")
+	}
+	if inline.SameData(inline) {
+		t.Error("Expected inline data to never be shared")
+	}
+	if encoded.SameData(encoded) {
+		t.Error("Expected encoded data to never be known to be shared")
+	}
+	if !unwritten.SameData(hole) {
+		t.Error("Expected unwritten extents and holes to have the same data")
+	}
+	if data.SameData(hole) {
+		t.Error("Expected data and holes to be different")
+	}
+}
+
+func TestInlineFilesDoNotShareFirstBlock(t *testing.T) {
+	inline := []sys.Fragment{{Logical: 0, Start: 0, Length: 100, Flags: sys.FIEMAP_EXTENT_DATA_INLINE}}
+	a := &FileInformation{Size: 100, Fragments: inline}
+	b := &FileInformation{Size: 100, Fragments: inline}
+	hole := &FileInformation{Size: 100}
+	if sameFirstBlock(a, b) || sameFirstBlock(a, hole) {
+		t.Error("Expected inline files to not share their first block")
+	}
+	if !sameFirstBlock(hole, hole) {
+		t.Error("Expected files starting with a hole to share their first block")
+	}
+}
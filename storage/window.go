@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"sync"
+)
+
+const (
+	// number of partitions per job in a window
+	partitionsPerJob = 64
+)
+
+// Processes partitions concurrently in windows of consecutive partitions. Because the partitions are sorted, the
+// reads for a window are close to each other. The results are passed to the consumer in the original order, so the
+// output remains deterministic.
+type window struct {
+	jobs       int
+	receiver   func(files []*FileInformation) bool
+	consumer   func(files []*FileInformation, ok bool)
+	partitions [][]*FileInformation
+}
+
+func newWindow(jobs int, receiver func(files []*FileInformation) bool, consumer func(files []*FileInformation, ok bool)) *window {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &window{jobs: jobs, receiver: receiver, consumer: consumer}
+}
+
+// Adds a partition to the window, the window is processed when it is full. The files slice may be reused by the
+// caller.
+func (w *window) add(files []*FileInformation) {
+	partition := make([]*FileInformation, len(files))
+	copy(partition, files)
+	w.partitions = append(w.partitions, partition)
+	if len(w.partitions) >= w.jobs*partitionsPerJob {
+		w.flush()
+	}
+}
+
+// Processes all partitions in the window
+func (w *window) flush() {
+	results := make([]bool, len(w.partitions))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < w.jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = w.receiver(w.partitions[i])
+			}
+		}()
+	}
+	for i := range w.partitions {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i, partition := range w.partitions {
+		w.consumer(partition, results[i])
+	}
+	w.partitions = w.partitions[:0]
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestWindowKeepsOrder(t *testing.T) {
+	var consumed []int32
+	w := newWindow(4, func(files []*FileInformation) bool {
+		return files[0].Path%2 == 0
+	}, func(files []*FileInformation, ok bool) {
+		if ok != (files[0].Path%2 == 0) {
+			t.Errorf("Unexpected result %v for partition %d", ok, files[0].Path)
+		}
+		consumed = append(consumed, files[0].Path)
+	})
+
+	partition := make([]*FileInformation, 1)
+	count := 4*partitionsPerJob + 10
+	for i := 0; i < count; i++ {
+		// the partition slice is reused, like the storage implementations do
+		partition[0] = &FileInformation{Path: int32(i)}
+		w.add(partition)
+	}
+	w.flush()
+
+	if len(consumed) != count {
+		t.Fatalf("Expected %d partitions, but was %d", count, len(consumed))
+	}
+	for i, path := range consumed {
+		if path != int32(i) {
+			t.Fatalf("Expected partition %d at position %d, but was %d", i, i, path)
+		}
+	}
+}
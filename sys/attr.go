@@ -0,0 +1,23 @@
+package sys
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	getFlagsOp = 0x80086601 // FS_IOC_GETFLAGS
+
+	FS_COMPR_FL = 0x00000004 /* Compress file */
+	FS_NOCOW_FL = 0x00800000 /* Do not cow file */
+)
+
+// Returns the FS_*_FL inode flags of the file, as shown by lsattr
+func InodeFlags(file *os.File) (uint32, error) {
+	// the kernel writes an int, although the ioctl is defined with a long
+	var flags uint64
+	if err := IOCTL(file.Fd(), getFlagsOp, uintptr(unsafe.Pointer(&flags))); err != nil {
+		return 0, err
+	}
+	return uint32(flags), nil
+}
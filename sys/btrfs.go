@@ -66,7 +66,7 @@ type BtrfsSameResult struct {
 func (result BtrfsSameResult) String() string {
 	s := fmt.Sprintf("Ok, %d bytes deduplicated", result.BytesDeduped)
 	if result.Error != nil {
-		s = fmt.Sprintf("Error: %s", result.Error)
+		s = fmt.Sprintf("Error: %s", *result.Error)
 	} else if result.DataDiffers {
 		s = "Data was different"
 	}
@@ -0,0 +1,114 @@
+package sys
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+const (
+	defragRangeOp = 0x40309410 // IOW(0x94, 16, 48)
+
+	// compress the data with the compression type while defragmenting
+	defragRangeCompress = 1
+	// start writing the defragmented data immediately, so the new extents are allocated when the ioctl returns
+	defragRangeStartIO = 2
+)
+
+type defragRangeArgs struct {
+	start         uint64 /* start of the range in bytes */
+	len           uint64 /* length of the range in bytes, (u64)-1 for the rest of the file */
+	flags         uint64
+	extent_thresh uint32 /* extents larger than this are not defragmented, 0 for the kernel default */
+	compress_type uint32
+	unused        [4]uint32
+}
+
+// Compression algorithm to recompress data with while defragmenting
+type Compression uint32
+
+const (
+	CompressNone Compression = iota
+	CompressZlib
+	CompressLzo
+	CompressZstd
+)
+
+var compressionNames = []string{"none", "zlib", "lzo", "zstd"}
+
+func (c Compression) String() string {
+	if int(c) < len(compressionNames) {
+		return compressionNames[c]
+	}
+	return fmt.Sprintf("compression(%d)", uint32(c))
+}
+
+// Returns the compression with the given name, one of none, zlib, lzo or zstd
+func ParseCompression(name string) (Compression, error) {
+	for i, n := range compressionNames {
+		if n == name {
+			return Compression(i), nil
+		}
+	}
+	return CompressNone, errors.Errorf("unknown compression %s, expected one of %s", name, strings.Join(compressionNames, ", "))
+}
+
+// Options for the defragmentation of a file
+type DefragOptions struct {
+	// range of the file to defragment, a length of 0 defragments the rest of the file
+	Start  uint64
+	Length uint64
+	// extents larger than this number of bytes are not defragmented, 0 for the kernel default
+	ExtentThreshold uint32
+	// recompresses the data if not CompressNone
+	Compression Compression
+}
+
+// Error returned by the kernel when defragmenting a range of a file
+type DefragError struct {
+	Start  uint64
+	Length uint64
+	Err    error
+}
+
+func (e *DefragError) Error() string {
+	if e.Length == 0 {
+		return fmt.Sprintf("defragmentation from offset %d failed: %v", e.Start, e.Err)
+	}
+	return fmt.Sprintf("defragmentation of %d bytes at offset %d failed: %v", e.Length, e.Start, e.Err)
+}
+
+func (e *DefragError) Cause() error {
+	return e.Err
+}
+
+func (e *DefragError) Unwrap() error {
+	return e.Err
+}
+
+// Defragments the range of the file with the BTRFS_IOC_DEFRAG_RANGE ioctl. Only the extents of this file are
+// rewritten, so data shared with snapshots or other files is unshared. The file must be opened for writing unless the
+// process has CAP_SYS_ADMIN. The writeback of the data is started, but not waited for, so the new extents may still be
+// delayed allocations when the ioctl returns. Callers rely on Fragments, which flushes the data with FIEMAP_FLAG_SYNC
+// and reads the fragments again when it finds delayed allocations, to see the new layout.
+func DefragRange(file *os.File, options DefragOptions) error {
+	args := defragRangeArgs{
+		start:         options.Start,
+		len:           options.Length,
+		flags:         defragRangeStartIO,
+		extent_thresh: options.ExtentThreshold,
+	}
+	if options.Length == 0 {
+		args.len = ^uint64(0)
+	}
+	if options.Compression != CompressNone {
+		args.flags |= defragRangeCompress
+		args.compress_type = uint32(options.Compression)
+	}
+	if err := IOCTL(file.Fd(), defragRangeOp, uintptr(unsafe.Pointer(&args))); err != nil {
+		return &DefragError{Start: options.Start, Length: options.Length, Err: err}
+	}
+	return nil
+}
@@ -9,8 +9,22 @@ import (
 const (
 	fiemapOp          = 0xc020660b
 	extendBufferCount = 20
+	fiemapMaxOffset   = ^uint64(0)
 
-	FIEMAP_EXTENT_LAST = 0x00000001 /* Last extent in file. */
+	FIEMAP_FLAG_SYNC = 0x00000001 /* sync file data before map */
+
+	FIEMAP_EXTENT_LAST        = 0x00000001 /* Last extent in file. */
+	FIEMAP_EXTENT_UNKNOWN     = 0x00000002 /* Data location unknown. */
+	FIEMAP_EXTENT_DELALLOC    = 0x00000004 /* Location still pending. Sets EXTENT_UNKNOWN. */
+	FIEMAP_EXTENT_ENCODED     = 0x00000008 /* Data can not be read while fs is unmounted */
+	FIEMAP_EXTENT_DATA_INLINE = 0x00000200 /* Data mixed with metadata. Sets EXTENT_NOT_ALIGNED. */
+	FIEMAP_EXTENT_UNWRITTEN   = 0x00000800 /* Space allocated, but no data (i.e. zero). */
+	FIEMAP_EXTENT_SHARED      = 0x00002000 /* Space shared with other files. */
+
+	// flags that are kept in the fragments
+	fragmentFlags = FIEMAP_EXTENT_UNKNOWN | FIEMAP_EXTENT_DELALLOC | FIEMAP_EXTENT_ENCODED | FIEMAP_EXTENT_DATA_INLINE | FIEMAP_EXTENT_UNWRITTEN | FIEMAP_EXTENT_SHARED
+	// flags of the extents of which the physical offset does not identify the data
+	unlocatedFlags = FIEMAP_EXTENT_UNKNOWN | FIEMAP_EXTENT_DELALLOC | FIEMAP_EXTENT_DATA_INLINE | FIEMAP_EXTENT_ENCODED
 )
 
 type fiemap_extent struct {
@@ -32,15 +46,65 @@ type fiemap struct {
 	fm_extents        [extendBufferCount]fiemap_extent // go doesn't support flexible array, so the easiest way is to fix the size with a constant
 }
 
+// A range of the file that is stored contiguously on disk. Ranges of a file that are not covered by a fragment are
+// holes.
 type Fragment struct {
+	// logical offset in the file
 	Logical uint64
+	// physical offset on disk
 	Start   uint64
 	Length  uint64
+	// FIEMAP_EXTENT_* flags that describe how the data is stored
+	Flags   uint32
+}
+
+// Returns true if the data is stored inline in the metadata. Inline data can not be deduplicated.
+func (f Fragment) Inline() bool {
+	return f.Flags&FIEMAP_EXTENT_DATA_INLINE != 0
+}
+
+// Returns true if the data is not yet allocated on disk
+func (f Fragment) Delalloc() bool {
+	return f.Flags&FIEMAP_EXTENT_DELALLOC != 0
+}
+
+// Returns true if the space is allocated, but not written. The data reads back as zeros.
+func (f Fragment) Unwritten() bool {
+	return f.Flags&FIEMAP_EXTENT_UNWRITTEN != 0
+}
+
+// Returns true if the data is encoded, i.e. compressed. The physical offset is the start of the encoded extent, the
+// offset of the data within it is not known, so files with the same physical offset may reference different data.
+func (f Fragment) Encoded() bool {
+	return f.Flags&FIEMAP_EXTENT_ENCODED != 0
 }
 
-// Returns all the fragments of the file in logical order. Sparse files are not supported with this function,
-// Therefore the logical offset is not needed.
+// Returns true if the data is also referenced by other files or snapshots, or more than once by this file
+func (f Fragment) Shared() bool {
+	return f.Flags&FIEMAP_EXTENT_SHARED != 0
+}
+
+// Returns true if the physical offset identifies the data, so that it can be compared with other fragments
+func (f Fragment) Located() bool {
+	return f.Flags&unlocatedFlags == 0
+}
+
+// Returns all the fragments of the file in logical order. For sparse files, the holes are not included. If the file
+// has data that is not allocated yet, the data is flushed and the fragments are read again.
 func Fragments(file *os.File) ([]Fragment, error) {
+	result, err := fragments(file, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, frag := range result {
+		if frag.Delalloc() {
+			return fragments(file, FIEMAP_FLAG_SYNC)
+		}
+	}
+	return result, nil
+}
+
+func fragments(file *os.File, flags uint32) ([]Fragment, error) {
 	var result []Fragment
 
 	start := uint64(0)
@@ -48,14 +112,16 @@ func Fragments(file *os.File) ([]Fragment, error) {
 	for !last {
 		var data fiemap
 		data.fm_start = start
-		data.fm_length = 1024 * 1024 * 1024
+		data.fm_length = fiemapMaxOffset - start
 		data.fm_extent_count = extendBufferCount
+		data.fm_flags = flags
 
 		if err := IOCTL(file.Fd(), fiemapOp, uintptr(unsafe.Pointer(&data))); err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "fiemap failed")
 		}
 		if data.fm_mapped_extents == 0 {
-			return nil, errors.New("No (more) extends found, file may be sparse")
+			// the rest of the file is a hole
+			break
 		}
 		for _, extend := range data.fm_extents[0:data.fm_mapped_extents] {
 			last = last || extend.fe_flags&FIEMAP_EXTENT_LAST != 0
@@ -63,13 +129,16 @@ func Fragments(file *os.File) ([]Fragment, error) {
 			if len(result) > 0 {
 				previous = &(result[len(result)-1])
 			}
-			if previous != nil && previous.Start + previous.Length == extend.fe_physical {
-				// merge contignues extents
-				previous.Length += extend.fe_length
+			fragment := Fragment{extend.fe_logical, extend.fe_physical, extend.fe_length, extend.fe_flags & fragmentFlags}
+			if previous != nil && previous.Start + previous.Length == fragment.Start && previous.Logical + previous.Length == fragment.Logical &&
+				previous.Flags&^FIEMAP_EXTENT_SHARED == fragment.Flags&^FIEMAP_EXTENT_SHARED && fragment.Located() && !fragment.Encoded() {
+				// merge contignues extents, the merged fragment is shared if any of them is
+				previous.Length += fragment.Length
+				previous.Flags |= fragment.Flags
 			} else {
-				result = append(result, Fragment{extend.fe_logical, extend.fe_physical, extend.fe_length})
+				result = append(result, fragment)
 			}
-			start += extend.fe_length
+			start = extend.fe_logical + extend.fe_length
 		}
 	}
 	return result, nil
@@ -0,0 +1,60 @@
+package sys
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"unsafe"
+)
+
+const (
+	fsInfoOp = 0x8400941f // IOR(0x94, 31, 1024)
+)
+
+type fsInfoArgs struct {
+	max_id          uint64
+	num_devices     uint64
+	fsid            [16]byte
+	nodesize        uint32
+	sectorsize      uint32
+	clone_alignment uint32
+	csum_type       uint16
+	csum_size       uint16
+	flags           uint64
+	generation      uint64
+	metadata_uuid   [16]byte
+	reserved        [944]byte
+}
+
+// Information about the filesystem that contains a file
+type FsInfo struct {
+	// UUID of the filesystem. For filesystems other than btrfs the filesystem id from statfs is used.
+	FSID [16]byte
+	// Size of the blocks in which data is allocated, deduplication must be aligned to this size
+	SectorSize uint32
+}
+
+// Returns the information of the filesystem that contains the file. For filesystems other than btrfs the block size
+// reported by statfs is used as sector size.
+func FilesystemInfo(file *os.File) (*FsInfo, error) {
+	var args fsInfoArgs
+	info := &FsInfo{}
+	if err := IOCTL(file.Fd(), fsInfoOp, uintptr(unsafe.Pointer(&args))); err == nil {
+		info.FSID = args.fsid
+		// kernels before 4.3 do not report the sector size
+		info.SectorSize = args.sectorsize
+	}
+	if info.SectorSize == 0 {
+		var stat unix.Statfs_t
+		if err := unix.Fstatfs(int(file.Fd()), &stat); err != nil {
+			return nil, errors.Wrap(err, "statfs failed")
+		}
+		info.SectorSize = uint32(stat.Bsize)
+		if info.FSID == [16]byte{} {
+			binary.LittleEndian.PutUint32(info.FSID[0:4], uint32(stat.Fsid.Val[0]))
+			binary.LittleEndian.PutUint32(info.FSID[4:8], uint32(stat.Fsid.Val[1]))
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,362 @@
+package sys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+const (
+	treeSearchV2Op = 0xc0709411 // IOWR(0x94, 17, 112)
+	inoLookupOp    = 0xd0009412 // IOWR(0x94, 18, 4096)
+
+	searchBufferSize = 64 * 1024
+	inoLookupPathMax = 4080
+
+	RootTreeObjectID  = 1
+	FsTreeObjectID    = 5
+	FirstFreeObjectID = 256
+
+	InodeItemKey  = 1
+	ExtentDataKey = 108
+	RootItemKey   = 132
+	RootRefKey    = 156
+
+	inodeItemSize = 160
+	rootRefSize   = 18
+
+	// offsets in the root item, the fields after generation_v2 are only valid if it equals the generation
+	rootGenerationV2Offset = inodeItemSize + 79
+	rootOtransidOffset     = inodeItemSize + 143
+)
+
+type searchKey struct {
+	tree_id      uint64
+	min_objectid uint64
+	max_objectid uint64
+	min_offset   uint64
+	max_offset   uint64
+	min_transid  uint64
+	max_transid  uint64
+	min_type     uint32
+	max_type     uint32
+	nr_items     uint32
+	unused       uint32
+	unused1      uint64
+	unused2      uint64
+	unused3      uint64
+	unused4      uint64
+}
+
+type searchArgsV2 struct {
+	key      searchKey
+	buf_size uint64
+	buf      [searchBufferSize]byte // go doesn't support flexible array, so the easiest way is to fix the size with a constant
+}
+
+type searchHeader struct {
+	transid  uint64
+	objectid uint64
+	offset   uint64
+	typ      uint32
+	len      uint32
+}
+
+type inoLookupArgs struct {
+	treeid   uint64
+	objectid uint64
+	name     [inoLookupPathMax]byte
+}
+
+// Key range for a tree search. Keys are compared as (ObjectID, Type, Offset), so the type and offset ranges only apply
+// to the first and last object id. Only items in leaves that are modified in a transaction of at least MinTransid are
+// returned.
+type SearchKey struct {
+	TreeID      uint64
+	MinObjectID uint64
+	MaxObjectID uint64
+	MinType     uint32
+	MaxType     uint32
+	MinOffset   uint64
+	MaxOffset   uint64
+	MinTransid  uint64
+}
+
+type SearchItem struct {
+	Transid  uint64
+	ObjectID uint64
+	Type     uint32
+	Offset   uint64
+	Data     []byte
+}
+
+// Passes all items in the given key range of the tree to the consumer. The file can be any file on the file system.
+// The data of an item is only valid during the call to the consumer. Requires CAP_SYS_ADMIN.
+func TreeSearch(file *os.File, key SearchKey, consumer func(item SearchItem)) error {
+	args := searchKey{
+		tree_id:      key.TreeID,
+		min_objectid: key.MinObjectID,
+		max_objectid: key.MaxObjectID,
+		min_offset:   key.MinOffset,
+		max_offset:   key.MaxOffset,
+		min_transid:  key.MinTransid,
+		max_transid:  ^uint64(0),
+		min_type:     key.MinType,
+		max_type:     key.MaxType,
+	}
+	return treeSearch(args, func(args *searchArgsV2) error {
+		return IOCTL(file.Fd(), treeSearchV2Op, uintptr(unsafe.Pointer(args)))
+	}, consumer)
+}
+
+// Repeats the search, which fills the buffer with the next batch of items, until all items in the key range are passed
+// to the consumer
+func treeSearch(key searchKey, search func(args *searchArgsV2) error, consumer func(item SearchItem)) error {
+	var args searchArgsV2
+	args.key = key
+	for {
+		args.key.nr_items = ^uint32(0)
+		args.buf_size = searchBufferSize
+		if err := search(&args); err != nil {
+			return errors.Wrap(err, "tree search failed")
+		}
+		if args.key.nr_items == 0 {
+			return nil
+		}
+		last, err := parseItems(args.buf[:], args.key.nr_items, consumer)
+		if err != nil {
+			return err
+		}
+		if !nextKey(&args.key, last) {
+			return nil
+		}
+	}
+}
+
+// Passes the given number of items in the buffer of a tree search to the consumer and returns the header of the last
+// one
+func parseItems(buf []byte, count uint32, consumer func(item SearchItem)) (searchHeader, error) {
+	var header searchHeader
+	headerSize := int(unsafe.Sizeof(header))
+	pos := 0
+	for i := uint32(0); i < count; i++ {
+		if pos+headerSize > len(buf) {
+			return header, errors.Errorf("tree search item %d of %d exceeds the buffer", i+1, count)
+		}
+		// the header is not necessarily aligned in the buffer, so copy it
+		copy((*[unsafe.Sizeof(searchHeader{})]byte)(unsafe.Pointer(&header))[:], buf[pos:pos+headerSize])
+		pos += headerSize
+		if pos+int(header.len) > len(buf) {
+			return header, errors.Errorf("tree search item %d of %d exceeds the buffer", i+1, count)
+		}
+		consumer(SearchItem{header.transid, header.objectid, header.typ, header.offset, buf[pos : pos+int(header.len)]})
+		pos += int(header.len)
+	}
+	return header, nil
+}
+
+// Moves the start of the key range directly after the last key that was found. Returns false if there is no key left
+// after it.
+func nextKey(key *searchKey, last searchHeader) bool {
+	key.min_objectid, key.min_type, key.min_offset = last.objectid, last.typ, last.offset
+	switch {
+	case key.min_offset < ^uint64(0):
+		key.min_offset++
+	case key.min_type < 0xff:
+		key.min_type++
+		key.min_offset = 0
+	case key.min_objectid < key.max_objectid:
+		key.min_objectid++
+		key.min_type = 0
+		key.min_offset = 0
+	default:
+		return false
+	}
+	return true
+}
+
+// Returns the path of the given inode relative to the root of the subvolume with the given id. Use treeID 0 for the
+// subvolume of the file. Requires CAP_SYS_ADMIN.
+func InodePath(file *os.File, treeID uint64, inode uint64) (string, error) {
+	var args inoLookupArgs
+	args.treeid = treeID
+	args.objectid = inode
+	if err := IOCTL(file.Fd(), inoLookupOp, uintptr(unsafe.Pointer(&args))); err != nil {
+		return "", errors.Wrapf(err, "lookup of inode %d failed", inode)
+	}
+	name := args.name[:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	// the kernel returns each path element followed by a slash
+	return strings.TrimSuffix(string(name), "/"), nil
+}
+
+// Returns the transaction id of the last change to the inode item of the file, which is also updated when its extents
+// are changed by deduplication or defragmentation, unlike the mtime and ctime. Requires CAP_SYS_ADMIN.
+func InodeTransid(file *os.File, inode uint64) (uint64, error) {
+	var transid uint64
+	found := false
+	// tree 0 is the subvolume of the file
+	key := SearchKey{MinObjectID: inode, MaxObjectID: inode, MinType: InodeItemKey, MaxType: InodeItemKey}
+	err := TreeSearch(file, key, func(item SearchItem) {
+		if item.Type == InodeItemKey && len(item.Data) >= inodeItemSize {
+			// the transid follows the generation in the inode item
+			transid = binary.LittleEndian.Uint64(item.Data[8:])
+			found = true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errors.Errorf("no inode item found for inode %d", inode)
+	}
+	return transid, nil
+}
+
+// Returns the id of the subvolume that contains the file
+func SubvolumeID(file *os.File) (uint64, error) {
+	var args inoLookupArgs
+	args.objectid = FirstFreeObjectID
+	if err := IOCTL(file.Fd(), inoLookupOp, uintptr(unsafe.Pointer(&args))); err != nil {
+		return 0, errors.Wrap(err, "subvolume lookup failed")
+	}
+	return args.treeid, nil
+}
+
+// Returns the root item of the subvolume with the given id
+func rootItem(file *os.File, id uint64) ([]byte, error) {
+	var data []byte
+	key := SearchKey{TreeID: RootTreeObjectID, MinObjectID: id, MaxObjectID: id, MinType: RootItemKey, MaxType: RootItemKey, MaxOffset: ^uint64(0)}
+	err := TreeSearch(file, key, func(item SearchItem) {
+		if item.Type == RootItemKey && len(item.Data) >= inodeItemSize+8 {
+			data = append([]byte(nil), item.Data...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.Errorf("no root item found for subvolume %d", id)
+	}
+	return data, nil
+}
+
+// Returns the generation (transaction id) of the last change to the subvolume with the given id
+func SubvolumeGeneration(file *os.File, id uint64) (uint64, error) {
+	item, err := rootItem(file, id)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(item[inodeItemSize:]), nil
+}
+
+// Returns the generation (transaction id) in which the subvolume with the given id was created, 0 for the top level
+// subvolume. Snapshots are created later than the subvolume they are taken of.
+func SubvolumeCreation(file *os.File, id uint64) (uint64, error) {
+	item, err := rootItem(file, id)
+	if err != nil {
+		return 0, err
+	}
+	generation := binary.LittleEndian.Uint64(item[inodeItemSize:])
+	if len(item) < rootOtransidOffset+8 || binary.LittleEndian.Uint64(item[rootGenerationV2Offset:]) != generation {
+		return 0, errors.Errorf("the root item of subvolume %d has no creation generation", id)
+	}
+	return binary.LittleEndian.Uint64(item[rootOtransidOffset:]), nil
+}
+
+// Subvolume with its path relative to the subvolume that was searched for nested subvolumes
+type Subvolume struct {
+	ID   uint64
+	Path string
+}
+
+// Returns the inode of the directory and the name of a subvolume in its parent from the data of a root ref item
+func parseRootRef(data []byte) (uint64, string, error) {
+	if len(data) < rootRefSize {
+		return 0, "", errors.Errorf("root ref of %d bytes is too short", len(data))
+	}
+	dirid := binary.LittleEndian.Uint64(data[0:])
+	nameLen := int(binary.LittleEndian.Uint16(data[16:]))
+	if len(data) < rootRefSize+nameLen {
+		return 0, "", errors.Errorf("root ref of %d bytes is too short for a name of %d bytes", len(data), nameLen)
+	}
+	return dirid, string(data[rootRefSize : rootRefSize+nameLen]), nil
+}
+
+// Returns all subvolumes nested in the subvolume with the given id, recursively
+func NestedSubvolumes(file *os.File, id uint64) ([]Subvolume, error) {
+	var children []Subvolume
+	var lookupErr error
+	key := SearchKey{TreeID: RootTreeObjectID, MinObjectID: id, MaxObjectID: id, MinType: RootRefKey, MaxType: RootRefKey, MaxOffset: ^uint64(0)}
+	err := TreeSearch(file, key, func(item SearchItem) {
+		if item.Type != RootRefKey || lookupErr != nil {
+			return
+		}
+		dirid, name, err := parseRootRef(item.Data)
+		if err != nil {
+			lookupErr = errors.Wrapf(err, "invalid reference to subvolume %d", item.Offset)
+			return
+		}
+		dir, err := InodePath(file, id, dirid)
+		if err != nil {
+			lookupErr = err
+			return
+		}
+		path := name
+		if dir != "" {
+			path = dir + "/" + name
+		}
+		children = append(children, Subvolume{item.Offset, path})
+	})
+	if err == nil {
+		err = lookupErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := children
+	for _, child := range children {
+		nested, err := NestedSubvolumes(file, child.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nested {
+			result = append(result, Subvolume{n.ID, child.Path + "/" + n.Path})
+		}
+	}
+	return result, nil
+}
+
+// Returns the inode numbers of the files in the subvolume with the given id that have file extents with a generation
+// of at least minTransid, like 'btrfs subvolume find-new' does.
+func FindNew(file *os.File, id uint64, minTransid uint64) ([]uint64, error) {
+	var inodes []uint64
+	key := SearchKey{TreeID: id, MaxObjectID: ^uint64(0), MaxType: ExtentDataKey, MaxOffset: ^uint64(0), MinTransid: minTransid}
+	err := TreeSearch(file, key, func(item SearchItem) {
+		inodes = appendNewInode(inodes, item, minTransid)
+	})
+	return inodes, err
+}
+
+// Appends the inode of the item if it is a file extent with a generation of at least minTransid and the inode is not
+// the last one yet. Items are ordered by inode, also over the batches of a tree search, so each inode is only appended
+// once.
+func appendNewInode(inodes []uint64, item SearchItem, minTransid uint64) []uint64 {
+	if item.Type != ExtentDataKey || len(item.Data) < 8 {
+		return inodes
+	}
+	// the generation is the first field of the file extent item
+	if binary.LittleEndian.Uint64(item.Data) < minTransid {
+		return inodes
+	}
+	if len(inodes) == 0 || inodes[len(inodes)-1] != item.ObjectID {
+		inodes = append(inodes, item.ObjectID)
+	}
+	return inodes
+}
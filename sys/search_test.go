@@ -0,0 +1,194 @@
+package sys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+// Appends the item with its header to the buffer like the kernel does
+func appendItem(buf []byte, item SearchItem) []byte {
+	header := searchHeader{item.Transid, item.ObjectID, item.Offset, item.Type, uint32(len(item.Data))}
+	buf = append(buf, (*[unsafe.Sizeof(searchHeader{})]byte)(unsafe.Pointer(&header))[:]...)
+	return append(buf, item.Data...)
+}
+
+func compareKeys(objectid uint64, typ uint32, offset uint64, item SearchItem) int {
+	switch {
+	case objectid != item.ObjectID:
+		if objectid < item.ObjectID {
+			return -1
+		}
+		return 1
+	case typ != item.Type:
+		if typ < item.Type {
+			return -1
+		}
+		return 1
+	case offset != item.Offset:
+		if offset < item.Offset {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// Returns a search that returns the sorted items in the key range in batches of whole items that fit in the buffer,
+// like the tree search ioctl does
+func fakeSearch(items []SearchItem, calls *int) func(args *searchArgsV2) error {
+	return func(args *searchArgsV2) error {
+		*calls++
+		var buf []byte
+		count := uint32(0)
+		for _, item := range items {
+			if compareKeys(args.key.min_objectid, args.key.min_type, args.key.min_offset, item) > 0 ||
+				compareKeys(args.key.max_objectid, args.key.max_type, args.key.max_offset, item) < 0 {
+				continue
+			}
+			next := appendItem(buf, item)
+			if uint64(len(next)) > args.buf_size || count == args.key.nr_items {
+				break
+			}
+			buf = next
+			count++
+		}
+		copy(args.buf[:], buf)
+		args.key.nr_items = count
+		return nil
+	}
+}
+
+func TestTreeSearchInBatches(t *testing.T) {
+	// 3 items fit in a batch, and the keys at the end of the offset and type ranges are at the end of a batch
+	var items []SearchItem
+	for _, key := range []struct {
+		objectid uint64
+		typ      uint32
+		offset   uint64
+	}{{256, 1, 0}, {256, 1, 5}, {256, 1, ^uint64(0)}, {256, 2, 0}, {256, 0xff, 3}, {256, 0xff, ^uint64(0)}, {257, 0, 0}, {257, 1, 0}} {
+		data := bytes.Repeat([]byte{byte(len(items))}, 20000)
+		items = append(items, SearchItem{uint64(len(items)), key.objectid, key.typ, key.offset, data})
+	}
+	key := searchKey{min_objectid: 256, max_objectid: 257, max_type: 0xff, max_offset: ^uint64(0), max_transid: ^uint64(0)}
+
+	calls := 0
+	var found []SearchItem
+	err := treeSearch(key, fakeSearch(items, &calls), func(item SearchItem) {
+		item.Data = append([]byte(nil), item.Data...)
+		found = append(found, item)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(items) {
+		t.Fatalf("Expected %d items, but found %d", len(items), len(found))
+	}
+	for i := range items {
+		if found[i].Transid != items[i].Transid || compareKeys(found[i].ObjectID, found[i].Type, found[i].Offset, items[i]) != 0 || !bytes.Equal(found[i].Data, items[i].Data) {
+			t.Errorf("Expected item %d to be %d %d %d, but was %d %d %d", i, items[i].ObjectID, items[i].Type, items[i].Offset, found[i].ObjectID, found[i].Type, found[i].Offset)
+		}
+	}
+	// 3 full batches and the search that returns nothing
+	if calls != 4 {
+		t.Errorf("Expected 4 searches, but were %d", calls)
+	}
+}
+
+func TestTreeSearchStopsAtLastKey(t *testing.T) {
+	items := []SearchItem{{1, 256, 0xff, ^uint64(0), []byte{1}}}
+	key := searchKey{min_objectid: 256, max_objectid: 256, max_type: 0xff, max_offset: ^uint64(0)}
+	calls := 0
+	count := 0
+	if err := treeSearch(key, fakeSearch(items, &calls), func(item SearchItem) { count++ }); err != nil {
+		t.Fatal(err)
+	}
+	// there is no key after the last one, so it isn't searched again
+	if count != 1 || calls != 1 {
+		t.Errorf("Expected 1 item in 1 search, but found %d in %d", count, calls)
+	}
+}
+
+func TestNextKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		last     searchHeader
+		ok       bool
+		objectid uint64
+		typ      uint32
+		offset   uint64
+	}{
+		{"offset", searchHeader{objectid: 256, typ: 1, offset: 7}, true, 256, 1, 8},
+		{"offset carries to type", searchHeader{objectid: 256, typ: 1, offset: ^uint64(0)}, true, 256, 2, 0},
+		{"type carries to object id", searchHeader{objectid: 256, typ: 0xff, offset: ^uint64(0)}, true, 257, 0, 0},
+		{"last key", searchHeader{objectid: 300, typ: 0xff, offset: ^uint64(0)}, false, 0, 0, 0},
+	}
+	for _, test := range tests {
+		key := searchKey{min_objectid: 1, max_objectid: 300}
+		ok := nextKey(&key, test.last)
+		if ok != test.ok {
+			t.Errorf("%s: expected %v, but was %v", test.name, test.ok, ok)
+			continue
+		}
+		if ok && (key.min_objectid != test.objectid || key.min_type != test.typ || key.min_offset != test.offset) {
+			t.Errorf("%s: unexpected key %d %d %d", test.name, key.min_objectid, key.min_type, key.min_offset)
+		}
+	}
+}
+
+func TestParseItemsRejectsTruncatedItem(t *testing.T) {
+	buf := appendItem(nil, SearchItem{1, 256, 1, 0, make([]byte, 100)})
+	if _, err := parseItems(buf[:len(buf)-1], 1, func(item SearchItem) {}); err == nil {
+		t.Errorf("Expected an error for an item that exceeds the buffer")
+	}
+	if _, err := parseItems(buf, 2, func(item SearchItem) {}); err == nil {
+		t.Errorf("Expected an error for more items than in the buffer")
+	}
+}
+
+func extentItem(inode uint64, offset uint64, generation uint64) SearchItem {
+	data := make([]byte, 53)
+	binary.LittleEndian.PutUint64(data, generation)
+	return SearchItem{generation, inode, ExtentDataKey, offset, data}
+}
+
+func TestAppendNewInode(t *testing.T) {
+	items := []SearchItem{
+		extentItem(257, 0, 5),
+		extentItem(257, 4096, 10),
+		extentItem(257, 8192, 11),
+		{10, 258, InodeItemKey, 0, make([]byte, inodeItemSize)},
+		extentItem(258, 0, 9),
+		extentItem(259, 0, 12),
+	}
+	var inodes []uint64
+	for _, item := range items {
+		inodes = appendNewInode(inodes, item, 10)
+	}
+	if len(inodes) != 2 || inodes[0] != 257 || inodes[1] != 259 {
+		t.Errorf("Expected inodes [257 259], but were %v", inodes)
+	}
+}
+
+func rootRef(dirid uint64, name string) []byte {
+	data := make([]byte, rootRefSize, rootRefSize+len(name))
+	binary.LittleEndian.PutUint64(data, dirid)
+	binary.LittleEndian.PutUint64(data[8:], 3)
+	binary.LittleEndian.PutUint16(data[16:], uint16(len(name)))
+	return append(data, name...)
+}
+
+func TestParseRootRef(t *testing.T) {
+	dirid, name, err := parseRootRef(rootRef(260, "snapshot"))
+	if err != nil || dirid != 260 || name != "snapshot" {
+		t.Errorf("Expected 260 snapshot, but was %d %s %v", dirid, name, err)
+	}
+	data := rootRef(260, "snapshot")
+	if _, _, err := parseRootRef(data[:len(data)-1]); err == nil {
+		t.Errorf("Expected an error for a truncated name")
+	}
+	if _, _, err := parseRootRef(data[:rootRefSize-1]); err == nil {
+		t.Errorf("Expected an error for a truncated root ref")
+	}
+}
@@ -0,0 +1,105 @@
+package sys
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"unsafe"
+)
+
+const (
+	spaceInfoOp = 0xc0109414 // IOWR(0x94, 20, 16)
+	devInfoOp   = 0xd000941e // IOWR(0x94, 30, 4096)
+	syncOp      = 0x00009408 // IO(0x94, 8)
+
+	BTRFS_BLOCK_GROUP_METADATA = 0x0004
+	// the global block reserve is reported as a metadata space, but is part of the metadata that is already counted
+	BTRFS_SPACE_INFO_GLOBAL_RSV = 1 << 49
+
+	spaceSlots = 32
+)
+
+type spaceInfo struct {
+	flags       uint64
+	total_bytes uint64
+	used_bytes  uint64
+}
+
+type spaceArgs struct {
+	space_slots  uint64
+	total_spaces uint64
+	spaces       [spaceSlots]spaceInfo // the kernel expects a flexible array with space_slots elements
+}
+
+type devInfoArgs struct {
+	devid       uint64
+	uuid        [16]byte
+	bytes_used  uint64 /* bytes allocated to chunks */
+	total_bytes uint64
+	unused      [379]uint64
+	path        [1024]byte
+}
+
+// The free space of a filesystem
+type Space struct {
+	// true if the filesystem is btrfs, the other fields are only reported for btrfs
+	Btrfs bool
+	// bytes available for new data according to statfs, which includes the unallocated space for btrfs
+	Available uint64
+	// bytes on the devices that are not allocated to data or metadata chunks yet
+	Unallocated uint64
+	// bytes that are free in the allocated metadata chunks
+	MetadataFree uint64
+}
+
+// Returns the free space of the filesystem that contains the file. For filesystems other than btrfs only the available
+// space is reported.
+func SpaceOf(file *os.File) (*Space, error) {
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(file.Fd()), &stat); err != nil {
+		return nil, errors.Wrap(err, "statfs failed")
+	}
+	space := &Space{Available: stat.Bavail * uint64(stat.Bsize)}
+
+	var args spaceArgs
+	args.space_slots = spaceSlots
+	if err := IOCTL(file.Fd(), spaceInfoOp, uintptr(unsafe.Pointer(&args))); err != nil {
+		// not a btrfs filesystem
+		return space, nil
+	}
+	space.Btrfs = true
+	count := args.total_spaces
+	if count > spaceSlots {
+		count = spaceSlots
+	}
+	for _, info := range args.spaces[:count] {
+		if info.flags&BTRFS_BLOCK_GROUP_METADATA != 0 && info.flags&BTRFS_SPACE_INFO_GLOBAL_RSV == 0 {
+			space.MetadataFree += info.total_bytes - info.used_bytes
+		}
+	}
+
+	var fsInfo fsInfoArgs
+	if err := IOCTL(file.Fd(), fsInfoOp, uintptr(unsafe.Pointer(&fsInfo))); err != nil {
+		return nil, errors.Wrap(err, "reading the filesystem info failed")
+	}
+	// device ids may have gaps when devices are removed
+	for id, found := uint64(1), uint64(0); id <= fsInfo.max_id && found < fsInfo.num_devices; id++ {
+		dev := devInfoArgs{devid: id}
+		if err := IOCTL(file.Fd(), devInfoOp, uintptr(unsafe.Pointer(&dev))); err == unix.ENODEV {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "reading the info of device %d failed", id)
+		}
+		found++
+		if dev.total_bytes > dev.bytes_used {
+			space.Unallocated += dev.total_bytes - dev.bytes_used
+		}
+	}
+	return space, nil
+}
+
+// Commits the current transaction of the filesystem that contains the file, after which the space of the extents that
+// are no longer referenced is freed
+func SyncFilesystem(file *os.File) error {
+	return IOCTL(file.Fd(), syncOp, 0)
+}
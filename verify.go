@@ -0,0 +1,247 @@
+package main
+
+import (
+	"container/list"
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+)
+
+const (
+	verifyChunkSize int64 = 1024 * 1024
+	// number of files the hasher keeps open. A partition can contain many thousands of files, like all files of
+	// which the first block is zero.
+	verifyOpenFiles = 256
+)
+
+// Calculates checksums of ranges of files. The most recently used files are kept open until close is called.
+type chunkHasher struct {
+	ctx     context
+	maxOpen int
+	files   map[int32]*list.Element
+	recent  *list.List // of *openFile, most recently used first
+	buffer  []byte
+}
+
+type openFile struct {
+	path int32
+	file *os.File
+}
+
+func newChunkHasher(ctx context, chunkSize int64, maxOpen int) *chunkHasher {
+	return &chunkHasher{ctx: ctx, maxOpen: maxOpen, files: make(map[int32]*list.Element), recent: list.New(), buffer: make([]byte, chunkSize)}
+}
+
+// Returns the opened file, closing the least recently used file if too many files are open
+func (h *chunkHasher) open(file *storage.FileInformation) (*os.File, error) {
+	if element, ok := h.files[file.Path]; ok {
+		h.recent.MoveToFront(element)
+		return element.Value.(*openFile).file, nil
+	}
+	f, err := os.Open(h.ctx.pathstore.FilePath(file.Path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file %s failed", h.ctx.pathstore.FilePath(file.Path))
+	}
+	if h.recent.Len() >= h.maxOpen {
+		oldest := h.recent.Remove(h.recent.Back()).(*openFile)
+		oldest.file.Close()
+		delete(h.files, oldest.path)
+	}
+	h.files[file.Path] = h.recent.PushFront(&openFile{file.Path, f})
+	return f, nil
+}
+
+func (h *chunkHasher) checksum(file *storage.FileInformation, offset, length int64) ([storage.MaxHashSize]byte, error) {
+	f, err := h.open(file)
+	if err != nil {
+		return [storage.MaxHashSize]byte{}, err
+	}
+	buffer := h.buffer[:length]
+	if _, err := f.ReadAt(buffer, offset); err != nil {
+		return [storage.MaxHashSize]byte{}, errors.Wrapf(err, "reading %d bytes at offset %d from %s", length, offset, f.Name())
+	}
+	return h.ctx.hash.sum(buffer), nil
+}
+
+func (h *chunkHasher) close() {
+	for element := h.recent.Front(); element != nil; element = element.Next() {
+		element.Value.(*openFile).file.Close()
+	}
+}
+
+// A group of files with equal content up to the given size
+type contentGroup struct {
+	files []*storage.FileInformation
+	size  int64
+}
+
+func (g contentGroup) value() int64 {
+	return int64(len(g.files)-1) * g.size
+}
+
+type chunkKey struct {
+	csum   [storage.MaxHashSize]byte
+	length int64
+}
+
+// Splits files with an equal first block into groups of files with verified equal content
+type contentVerifier struct {
+	chunkSize int64
+	checksum  func(file *storage.FileInformation, offset, length int64) ([storage.MaxHashSize]byte, error)
+}
+
+// Returns the number of bytes from offset that all files store at the same physical location or that are zero in all
+// files. There is no need to read this data to know that it is equal.
+func sharedLength(files []*storage.FileInformation, offset int64) int64 {
+	first := files[0].PhysicalExtentAt(offset)
+	length := first.Length
+	for _, file := range files[1:] {
+		extent := file.PhysicalExtentAt(offset)
+		if !extent.SameData(first) {
+			return 0
+		}
+		if extent.Length < length {
+			length = extent.Length
+		}
+	}
+	return int64(length)
+}
+
+// Returns the groups of files with equal content, each file will be in at most one group. The groups are chosen such
+// that the number of bytes that can be deduplicated is maximized. The size of the groups is either a multiple of the
+// chunk size or the size of all files in the group.
+func (v *contentVerifier) verify(files []*storage.FileInformation) []contentGroup {
+	groups, _ := v.split(files, 0)
+	return groups
+}
+
+// Splits files that are known to be equal up to offset. Returns the groups and the number of bytes that can be
+// deduplicated by these groups.
+func (v *contentVerifier) split(files []*storage.FileInformation, offset int64) ([]contentGroup, int64) {
+	for len(files) > 1 {
+		var keys []chunkKey
+		partitions := make(map[chunkKey][]*storage.FileInformation)
+		ended := 0
+		var active []*storage.FileInformation
+		for _, file := range files {
+			if file.Size <= offset {
+				ended++
+			} else {
+				active = append(active, file)
+			}
+		}
+		if ended == 0 {
+			if skip := v.sharedSkip(active, offset); skip > 0 {
+				offset += skip
+				continue
+			}
+		}
+
+		failed := false
+		for _, file := range active {
+			key := chunkKey{length: v.chunkLength(file, offset)}
+			csum, err := v.checksum(file, offset, key.length)
+			if err != nil {
+				log.Printf("Error while verifying the content of a file: %v", err)
+				file.Error = true
+				failed = true
+				continue
+			}
+			key.csum = csum
+			if _, ok := partitions[key]; !ok {
+				keys = append(keys, key)
+			}
+			partitions[key] = append(partitions[key], file)
+		}
+		if failed {
+			files = withoutErrors(files)
+			continue
+		}
+
+		if ended == 0 && len(keys) == 1 {
+			offset += keys[0].length
+			continue
+		}
+
+		whole := contentGroup{files, offset}
+		var groups []contentGroup
+		var value int64
+		for _, key := range keys {
+			subGroups, subValue := v.split(partitions[key], offset+key.length)
+			groups = append(groups, subGroups...)
+			value += subValue
+		}
+		if len(active) == 0 || value <= whole.value() {
+			if offset == 0 {
+				return nil, 0
+			}
+			return []contentGroup{whole}, whole.value()
+		}
+		return groups, value
+	}
+	return nil, 0
+}
+
+func (v *contentVerifier) chunkLength(file *storage.FileInformation, offset int64) int64 {
+	length := file.Size - offset
+	if length > v.chunkSize {
+		length = v.chunkSize
+	}
+	return length
+}
+
+// Returns the number of bytes from offset that are known to be equal because they are physically shared. Unless the
+// files are shared up to their common end, this is a multiple of the chunk size so that the groups stay aligned.
+func (v *contentVerifier) sharedSkip(files []*storage.FileInformation, offset int64) int64 {
+	minSize, maxSize := files[0].Size, files[0].Size
+	for _, file := range files[1:] {
+		if file.Size < minSize {
+			minSize = file.Size
+		}
+		if file.Size > maxSize {
+			maxSize = file.Size
+		}
+	}
+	shared := sharedLength(files, offset)
+	if minSize == maxSize && offset+shared >= minSize {
+		return minSize - offset
+	}
+	if offset+shared > minSize {
+		shared = minSize - offset
+	}
+	return shared - shared%v.chunkSize
+}
+
+func withoutErrors(files []*storage.FileInformation) []*storage.FileInformation {
+	result := make([]*storage.FileInformation, 0, len(files))
+	for _, file := range files {
+		if !file.Error {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// Verifies the content of the files which have an equal first block. Returns the groups of files that have equal
+// content, with EqualSize set to the size up to which the files in the group are equal
+func verifyContent(ctx context, files []*storage.FileInformation) [][]*storage.FileInformation {
+	var result [][]*storage.FileInformation
+	grouped := 0
+	defer func() { ctx.stats.ContentVerified(len(files), grouped) }()
+	if len(files) < 2 || ctx.interrupt.interrupted() {
+		return nil
+	}
+
+	hasher := newChunkHasher(ctx, verifyChunkSize, verifyOpenFiles)
+	defer hasher.close()
+	verifier := contentVerifier{chunkSize: verifyChunkSize, checksum: hasher.checksum}
+	for _, group := range verifier.verify(files) {
+		for _, file := range group.files {
+			file.EqualSize = group.size
+		}
+		grouped += len(group.files)
+		result = append(result, group.files)
+	}
+	return result
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/bertbaron/btrdedup/storage"
+	"github.com/bertbaron/btrdedup/sys"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// creates a file with the given content, where each character represents a chunk of one byte, stored at the given
+// physical offset
+func verifyFile(path int32, content string, physical uint64) *storage.FileInformation {
+	fragments := []sys.Fragment{{Logical: 0, Start: physical, Length: uint64(len(content))}}
+	return &storage.FileInformation{Path: path, Size: int64(len(content)), Fragments: fragments}
+}
+
+func verifyGroups(files []*storage.FileInformation, contents map[int32]string) ([]contentGroup, int) {
+	reads := 0
+	verifier := contentVerifier{chunkSize: 1, checksum: func(file *storage.FileInformation, offset, length int64) ([storage.MaxHashSize]byte, error) {
+		reads++
+		return digest([]byte(contents[file.Path][offset : offset+length])), nil
+	}}
+	return verifier.verify(files), reads
+}
+
+func assertGroup(t *testing.T, group contentGroup, size int64, paths ...int32) {
+	if group.size != size {
+		t.Errorf("Expected group size %d, but was %d", size, group.size)
+	}
+	if len(group.files) != len(paths) {
+		t.Fatalf("Expected %d files in group, but was %d", len(paths), len(group.files))
+	}
+	for i, file := range group.files {
+		if file.Path != paths[i] {
+			t.Errorf("Expected file %d at position %d, but was %d", paths[i], i, file.Path)
+		}
+	}
+}
+
+func TestVerifyEqualFiles(t *testing.T) {
+	contents := map[int32]string{0: "abcd", 1: "abcd", 2: "abcd"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 10), verifyFile(2, contents[2], 20)}
+	groups, _ := verifyGroups(files, contents)
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, but was %v", groups)
+	}
+	assertGroup(t, groups[0], 4, 0, 1, 2)
+}
+
+func TestVerifySplitsOnLargestValue(t *testing.T) {
+	// files 0 and 1 are equal, file 2 only shares the first chunk and should not limit the size of the others
+	contents := map[int32]string{0: "abcdef", 1: "abcdef", 2: "axxxxx", 3: "ab"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 10), verifyFile(2, contents[2], 20), verifyFile(3, contents[3], 30)}
+	groups, _ := verifyGroups(files, contents)
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, but was %v", groups)
+	}
+	assertGroup(t, groups[0], 6, 0, 1)
+}
+
+func TestVerifyKeepsPrefixGroup(t *testing.T) {
+	contents := map[int32]string{0: "abcd", 1: "abcx", 2: "abcy"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 10), verifyFile(2, contents[2], 20)}
+	groups, _ := verifyGroups(files, contents)
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, but was %v", groups)
+	}
+	assertGroup(t, groups[0], 3, 0, 1, 2)
+}
+
+func TestVerifyDifferentFiles(t *testing.T) {
+	contents := map[int32]string{0: "abcd", 1: "xbcd"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 10)}
+	groups, _ := verifyGroups(files, contents)
+	if len(groups) != 0 {
+		t.Fatalf("Expected no groups, but was %v", groups)
+	}
+}
+
+func TestVerifySkipsSharedData(t *testing.T) {
+	contents := map[int32]string{0: "abcd", 1: "abcd"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 0)}
+	groups, reads := verifyGroups(files, contents)
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, but was %v", groups)
+	}
+	assertGroup(t, groups[0], 4, 0, 1)
+	if reads != 0 {
+		t.Errorf("Expected no reads for physically shared files, but was %d", reads)
+	}
+}
+
+func TestVerifySkipsCommonHoles(t *testing.T) {
+	contents := map[int32]string{0: "a\x00\x00d", 1: "a\x00\x00d"}
+	files := []*storage.FileInformation{verifyFile(0, contents[0], 0), verifyFile(1, contents[1], 10)}
+	for _, file := range files {
+		start := file.Fragments[0].Start
+		file.Fragments = []sys.Fragment{{Logical: 0, Start: start, Length: 1}, {Logical: 3, Start: start + 3, Length: 1}}
+	}
+	groups, reads := verifyGroups(files, contents)
+	if len(groups) != 1 {
+		t.Fatalf("Expected one group, but was %v", groups)
+	}
+	assertGroup(t, groups[0], 4, 0, 1)
+	if reads != 4 {
+		t.Errorf("Expected only the data to be read, but was %d reads", reads)
+	}
+}
+
+func TestHasherLimitsOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrdedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := hashAlgorithmByName("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context{pathstore: storage.NewPathStorage(), hash: hash}
+	var files []*storage.FileInformation
+	for _, content := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, content)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, &storage.FileInformation{Path: addPath(ctx.pathstore, path), Size: 1})
+	}
+
+	hasher := newChunkHasher(ctx, 1, 2)
+	defer hasher.close()
+	first, _ := hasher.checksum(files[0], 0, 1)
+	for _, file := range files {
+		if _, err := hasher.checksum(file, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+		if hasher.recent.Len() > 2 {
+			t.Errorf("Expected at most 2 open files, but were %d", hasher.recent.Len())
+		}
+	}
+	// the first file is closed and opened again
+	if again, err := hasher.checksum(files[0], 0, 1); err != nil || again != first {
+		t.Errorf("Expected the same checksum after reopening the file, but was %v (%v)", again, err)
+	}
+}